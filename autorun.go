@@ -0,0 +1,121 @@
+/*
+ * Whitecat Blocky Environment, run modes
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Run modes
+const (
+	runEphemeral = "ephemeral"
+	runFile      = "file"
+	runAutorun   = "autorun"
+)
+
+const autorunFile = "/autorun.lua"
+const autorunBackupFile = "/autorun.lua.bak"
+
+// First line of the autorun.lua files written by the agent
+const autorunMark = "-- written by the Whitecat Create Agent"
+
+// autorun.lua written by previous versions of the agent
+var oldAgentAutorunRe = regexp.MustCompile(`^dofile\("[^"]*"\)\s*$`)
+
+// Get an autorun.lua that runs path
+func agentAutorun(path string) []byte {
+	return []byte(autorunMark + "\r\n" + luaCall("dofile", path) + "\r\n")
+}
+
+func isAgentAutorun(content []byte) bool {
+	return strings.HasPrefix(string(content), autorunMark) || oldAgentAutorunRe.Match(content)
+}
+
+func (board *Board) fileExists(path string) bool {
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(2000)
+	exists := board.sendCommand(luaWithAttributes(path, "print(att ~= nil and att.type == \"file\");"))
+	board.noTimeout()
+	board.consoleOut = true
+	board.consoleIn = false
+
+	return exists == "true"
+}
+
+// Backup autorun.lua, if it was not written by the agent. If the backup
+// fails, autorun.lua must not be written.
+func (board *Board) backupAutorun() error {
+	if !board.fileExists(autorunFile) {
+		return nil
+	}
+
+	content := board.readFile(autorunFile)
+	if content == nil {
+		return errors.New("can't read " + autorunFile)
+	}
+
+	if isAgentAutorun(content) {
+		return nil
+	}
+
+	log.Println("backing up " + autorunFile)
+
+	if board.writeFile(autorunBackupFile, content) == "" {
+		return errors.New("can't write " + autorunBackupFile)
+	}
+
+	return nil
+}
+
+// Restore the autorun.lua backup
+func (board *Board) restoreAutorun() error {
+	if !board.fileExists(autorunBackupFile) {
+		return errors.New("there is not an autorun.lua backup")
+	}
+
+	content := board.readFile(autorunBackupFile)
+	if content == nil {
+		return errors.New("can't read " + autorunBackupFile)
+	}
+
+	if board.writeFile(autorunFile, content) == "" {
+		return errors.New("can't write " + autorunFile)
+	}
+
+	if err := board.removeFile(autorunBackupFile); err != nil {
+		return errors.New("can't remove " + autorunBackupFile + ": " + err.Error())
+	}
+
+	return nil
+}
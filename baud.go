@@ -0,0 +1,135 @@
+/*
+ * Whitecat Blocky Environment, baud rate negotiation
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/mikepb/go-serial"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Baud rate used by the board when booting
+const bootBauds = 115200
+
+// Number of attempts for verify a baud rate
+const baudVerifyAttempts = 2
+
+// Set the serial port baud rate, at the host side
+func (board *Board) setBauds(bauds int) error {
+	options := serial.RawOptions
+	options.BitRate = bauds
+	options.Mode = serial.MODE_READ_WRITE
+
+	return board.port.Apply(&options)
+}
+
+// Change the baud rate at both sides, the board and the host
+func (board *Board) changeBauds(bauds int) {
+	board.port.Write([]byte("uart.attach(uart.UART0, " + strconv.Itoa(bauds) + ", 8, uart.PARNONE, uart.STOP1)\r\n"))
+	board.port.Sync()
+	time.Sleep(time.Millisecond * 50)
+
+	board.setBauds(bauds)
+	time.Sleep(time.Millisecond * 10)
+	board.consume()
+}
+
+// Test that board and host can talk, with a round-trip echo
+func (board *Board) verifyBauds() (err error) {
+	defer func() {
+		board.noTimeout()
+
+		if r := recover(); r != nil {
+			// Only a read timeout means that the baud rate doesn't work, any
+			// other error (board detached, ...) must go up to attach
+			e, ok := r.(error)
+			if !ok || e.Error() != "timeout" {
+				panic(r)
+			}
+
+			err = e
+		}
+	}()
+
+	for attempt := 0; attempt < baudVerifyAttempts; attempt++ {
+		token := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+		board.timeout(500)
+		if board.sendCommand("print(\"wcc-"+token+"\")") == "wcc-"+token {
+			return nil
+		}
+
+		board.consume()
+	}
+
+	return errors.New("echo mismatch")
+}
+
+// Raise the baud rate up to the board's max bauds. If the board doesn't work at
+// the requested baud rate, falls back to the boot baud rate. The achieved baud
+// rate is stored in board.bauds.
+func (board *Board) negotiateBauds() {
+	board.bauds = bootBauds
+
+	if board.maxBauds <= bootBauds {
+		return
+	}
+
+	log.Println("changing baud rate to " + strconv.Itoa(board.maxBauds) + " ...")
+
+	board.consoleOut = false
+	board.consoleIn = true
+
+	board.changeBauds(board.maxBauds)
+
+	err := board.verifyBauds()
+	if err == nil {
+		board.bauds = board.maxBauds
+		log.Println("baud rate changed to " + strconv.Itoa(board.bauds))
+		return
+	}
+
+	log.Println("board doesn't work at "+strconv.Itoa(board.maxBauds)+" bauds, falling back to "+strconv.Itoa(bootBauds), err)
+
+	// Board can be at any of both baud rates
+	board.changeBauds(bootBauds)
+
+	if err := board.verifyBauds(); err != nil {
+		board.setBauds(bootBauds)
+		board.port.Write([]byte("\r\n"))
+		board.consume()
+
+		if err := board.verifyBauds(); err != nil {
+			panic(err)
+		}
+	}
+}
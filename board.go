@@ -31,7 +31,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,7 +43,6 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -74,9 +72,22 @@ type SupportedBoards []SupportedBoard
 
 var Upgrading bool
 
+// Serializes the use of the connected board
+var BoardMutex sync.Mutex
+
+// Serial port of a board, a serial.Port except in the tests
+type boardPort interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	Apply(o *serial.Options) error
+	Sync() error
+	InputWaiting() (int, error)
+}
+
 type Board struct {
 	// Serial port
-	port    *serial.Port
+	port    boardPort
 	devInfo *serial.Info
 
 	// Device name
@@ -94,6 +105,7 @@ type Board struct {
 	brand    string
 	ota      bool
 	firmware string
+	commit   string
 
 	// Has board shell enable?
 	shell bool
@@ -110,7 +122,9 @@ type Board struct {
 	consoleOut bool
 	consoleIn  bool
 
-	quit chan bool
+	// Closed when the board is detached, for unblock the reads
+	quit     chan bool
+	quitOnce sync.Once
 
 	// Current timeout value, in milliseconds for read
 	timeoutVal int
@@ -123,6 +137,45 @@ type Board struct {
 
 	// Max bauds for this board
 	maxBauds int
+
+	// Current bauds
+	bauds int
+
+	// Reset method for this board
+	resetMethod string
+
+	// Inspector rules
+	rules []*InspectorRule
+
+	// Panic dump collector
+	panics *panicCollector
+
+	// Sources of the files sent to the board
+	sources *sourceCache
+
+	// Runtime error collector
+	luaErrors *luaErrorCollector
+
+	// Block execution profiler
+	profiler *blockProfiler
+
+	// Telemetry poller
+	telemetry *telemetryPoller
+
+	// Programs run on the board
+	runs *runTracker
+
+	// Last time the user has sent something to the console
+	lastConsoleIn time.Time
+
+	// Key of the board in the inventory
+	inventoryKey string
+
+	// Chip information
+	chip ChipInfo
+
+	// Evaluation helper is in the board
+	evalHelper bool
 }
 
 type BoardInfo struct {
@@ -151,8 +204,6 @@ func (board *Board) noTimeout() {
 //
 // Once inspected all bytes are send to RXQueue channel
 func (board *Board) inspector() {
-	var re *regexp.Regexp
-
 	defer func() {
 		log.Println("stop inspector ...")
 
@@ -172,90 +223,9 @@ func (board *Board) inspector() {
 		} else {
 			if n > 0 {
 				if buffer[0] == '\n' {
-					if !board.disableInspectorBootNotify {
-						re = regexp.MustCompile(`^rst:.*\(POWERON_RESET\),boot:.*(.*)$`)
-						if re.MatchString(line) {
-							notify("boardPowerOnReset", "")
-						}
-
-						re = regexp.MustCompile(`^rst:.*(SW_CPU_RESET),boot:.*(.*)$`)
-						if re.MatchString(line) {
-							notify("boardSoftwareReset", "")
-						}
-
-						re = regexp.MustCompile(`^rst:.*(DEEPSLEEP_RESET),boot.*(.*)$`)
-						if re.MatchString(line) {
-							notify("boardDeepSleepReset", "")
-						}
-
-						re = regexp.MustCompile(`\<blockStart,(.*)\>`)
-						if re.MatchString(line) {
-							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockStart", info)
-						}
-
-						re = regexp.MustCompile(`\<blockEnd,(.*)\>`)
-						if re.MatchString(line) {
-							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockEnd", info)
-						}
-
-						re = regexp.MustCompile(`\<blockError,([0-9]*),(.*)\>`)
-						if re.MatchString(line) {
-							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\", " +
-								"\"error\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[2])) + "\""
-
-							notify("blockError", info)
-						}
-
-						re = regexp.MustCompile(`\<blockErrorCatched,(.*)\>`)
-						if re.MatchString(line) {
-							parts := re.FindStringSubmatch(line)
-							info := "\"block\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[1])) + "\""
-							notify("blockErrorCatched", info)
-						}
-					}
-
-					// Remove prompt from line
-					tmpLine := line
-					re = regexp.MustCompile(`^/.*>\s`)
-					tmpLine = string(re.ReplaceAll([]byte(tmpLine), []byte("")))
-
-					re = regexp.MustCompile(`^([\/\.\/\-_a-zA-Z]*):(\d*)\:\s(\d*)\:(.*)$`)
-					if re.MatchString(tmpLine) {
-						parts := re.FindStringSubmatch(tmpLine)
-
-						info := "\"where\": \"" + parts[1] + "\", " +
-							"\"line\": \"" + parts[2] + "\", " +
-							"\"exception\": \"" + parts[3] + "\", " +
-							"\"message\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[4])) + "\""
-						log.Println(parts[4])
-
-						re = regexp.MustCompile(`^WARNING\s.*$`)
-						if re.MatchString(parts[4]) {
-							notify("boardRuntimeWarning", info)
-						} else {
-							notify("boardRuntimeError", info)
-						}
-					} else {
-						re = regexp.MustCompile(`^([\/\.\/\-_a-zA-Z]*)\:(\d*)\:\s*(.*)$`)
-						if re.MatchString(tmpLine) {
-							parts := re.FindStringSubmatch(tmpLine)
-
-							info := "\"where\": \"" + parts[1] + "\", " +
-								"\"line\": \"" + parts[2] + "\", " +
-								"\"exception\": \"0\", " +
-								"\"message\": \"" + base64.StdEncoding.EncodeToString([]byte(parts[3])) + "\""
-
-							re = regexp.MustCompile(`^WARNING\s.*$`)
-							if re.MatchString(parts[3]) {
-								notify("boardRuntimeWarning", info)
-							} else {
-								notify("boardRuntimeError", info)
-							}
+					if !board.luaErrors.feed(line) && !board.panics.feed(line) {
+						for _, event := range inspectLine(board.rules, line, !board.disableInspectorBootNotify) {
+							board.dispatch(event)
 						}
 					}
 
@@ -263,6 +233,11 @@ func (board *Board) inspector() {
 				} else {
 					if buffer[0] != '\r' {
 						line = line + string(buffer[0])
+
+						// The prompt is not followed by a new line
+						if buffer[0] == ' ' && runPromptRe.MatchString(line) {
+							board.runs.prompt()
+						}
 					}
 				}
 
@@ -278,6 +253,36 @@ func (board *Board) inspector() {
 	}
 }
 
+// Dispatch an event found by the inspector
+func (board *Board) dispatch(event *InspectorEvent) {
+	switch event.Notification {
+	case "blockStart":
+		board.luaErrors.blockStart(event.Fields["block"])
+		board.profiler.blockStart(event.Fields["block"])
+
+	case "blockEnd":
+		board.luaErrors.blockEnd(event.Fields["block"])
+		board.profiler.blockEnd(event.Fields["block"])
+
+	case "blockError":
+		board.profiler.blockError(event.Fields["block"], event.Fields["error"])
+
+	case "boardPowerOnReset", "boardSoftwareReset", "boardDeepSleepReset":
+		board.runs.reboot(event.Notification)
+
+	case "boardRuntimeError", "boardRuntimeWarning":
+		if event.Notification == "boardRuntimeError" {
+			board.runs.error(event.Fields["where"] + ":" + event.Fields["line"] + ": " + event.Fields["message"])
+		}
+
+		// Notification is sent when the traceback is collected
+		board.luaErrors.start(event)
+		return
+	}
+
+	notify(event.Notification, event.Info)
+}
+
 func (board *Board) attach(info *serial.Info) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -301,10 +306,9 @@ func (board *Board) attach(info *serial.Info) {
 
 	// Configure options or serial port connection
 	options := serial.RawOptions
-	options.BitRate = 115200
+	options.BitRate = bootBauds
 	options.Mode = serial.MODE_READ_WRITE
-	options.DTR = serial.DTR_OFF
-	options.RTS = serial.RTS_OFF
+	options.DTR, options.RTS = board.resetStrategies()[0].Lines()
 
 	// Open port
 	port, openErr := options.Open(info.Name())
@@ -322,12 +326,21 @@ func (board *Board) attach(info *serial.Info) {
 	board.consoleIn = false
 	board.quit = make(chan bool)
 	board.timeoutVal = math.MaxInt32
+	board.bauds = bootBauds
 	board.validFirmware = true
 	board.validPrerequisites = true
+	board.rules = inspectorRules()
+	board.panics = &panicCollector{}
+	board.sources = &sourceCache{}
+	board.luaErrors = &luaErrorCollector{sources: board.sources}
+	board.profiler = newBlockProfiler()
+	board.telemetry = newTelemetryPoller(board)
+	board.runs = newRunTracker()
 
 	Upgrading = false
 
 	go board.inspector()
+	go board.telemetry.run()
 
 	// Reset the board
 	board.reset(true)
@@ -344,10 +357,22 @@ func (board *Board) detach() {
 
 	// Close board
 	if board != nil {
-		log.Println("closing serial port ...")
+		board.disconnected()
+
+		// Close serial port. The board can be detached twice, if the attach
+		// failed.
+		if board.port != nil {
+			log.Println("closing serial port ...")
 
-		// Close serial port
-		board.port.Close()
+			board.port.Close()
+			board.port = nil
+		}
+
+		// Stop telemetry
+		if board.telemetry != nil {
+			close(board.telemetry.stop)
+			board.telemetry = nil
+		}
 
 		time.Sleep(time.Millisecond * 1000)
 	}
@@ -355,6 +380,16 @@ func (board *Board) detach() {
 	connectedBoard = nil
 }
 
+// Board is not connected. The reads waiting for the board panic, so the
+// commands using the board end.
+func (board *Board) disconnected() {
+	board.quitOnce.Do(func() {
+		if board.quit != nil {
+			close(board.quit)
+		}
+	})
+}
+
 /*
  * Serial port primitives
  */
@@ -368,10 +403,17 @@ func (board *Board) read() byte {
 				return c
 			case <-time.After(time.Millisecond * time.Duration(board.timeoutVal)):
 				panic(errors.New("timeout"))
+			case <-board.quit:
+				panic(errors.New("board detached"))
 			}
 		}
 	} else {
-		return <-board.RXQueue
+		select {
+		case c := <-board.RXQueue:
+			return c
+		case <-board.quit:
+			panic(errors.New("board detached"))
+		}
 	}
 }
 
@@ -431,100 +473,100 @@ func (board *Board) consume() {
 	}
 }
 
-// Wait until board is ready
-func (board *Board) waitForReady() bool {
-	booting := false
-	whitecat := false
-	failingBack := 0
-
-	line := ""
+// Read one line from RXQueue, waiting until deadline. Returns false if
+// deadline is reached.
+func (board *Board) readLineUntil(deadline time.Time) (string, bool) {
+	var buffer bytes.Buffer
 
-	vendorId, productId, _ := board.devInfo.USBVIDPID()
+	for {
+		select {
+		case b := <-board.RXQueue:
+			if b == '\n' {
+				return buffer.String(), true
+			} else if b != '\r' {
+				buffer.WriteByte(b)
+			}
+		case <-time.After(time.Until(deadline)):
+			return buffer.String(), false
+		case <-board.quit:
+			panic(errors.New("board detached"))
+		}
+	}
+}
 
-	board.timeout(4000)
+// Read one line from RXQueue, waiting until deadline. The prompt is returned
+// as a line, although it doesn't end with a new line. Returns false if
+// deadline is reached.
+func (board *Board) readLineOrPrompt(deadline time.Time) (string, bool) {
+	var buffer bytes.Buffer
 
 	for {
 		select {
-		case <-time.After(time.Millisecond * time.Duration(board.timeoutVal)):
-			panic(errors.New("timeout"))
-		default:
-			line = board.readLineCRLF()
-
-			if regexp.MustCompile(`^.*formatting\s{0,1}\.\.\.$`).MatchString(line) {
-				log.Println("board is formatting the file system, setting time out to 120 seconds")
-				board.timeout(120000)
-				notify("boardUpdate", "Board is formatting the file system, please, wait ...")
+		case b := <-board.RXQueue:
+			if b == '\n' {
+				return buffer.String(), true
+			} else if b != '\r' {
+				buffer.WriteByte(b)
 			}
 
-			if regexp.MustCompile(`^.*formating\s{0,1}\.\.\.$`).MatchString(line) {
-				log.Println("board is formatting the file system, setting time out to 80 seconds")
-				board.timeout(120000)
-				notify("boardUpdate", "Board is formatting the file system, please, wait ...")
+			if b == ' ' && runPromptRe.Match(buffer.Bytes()) {
+				return buffer.String(), true
 			}
+		case <-time.After(time.Until(deadline)):
+			return buffer.String(), false
+		case <-board.quit:
+			panic(errors.New("board detached"))
+		}
+	}
+}
 
-			if regexp.MustCompile(`^.*boot: Failed to verify app image.*$`).MatchString(line) {
-				board.validFirmware = false
-				board.validPrerequisites = false
-				notify("invalidFirmware", "")
-				return false
-			}
+// Wait until board is ready. Returns false if the board has booted, but has
+// an invalid firmware.
+func (board *Board) waitForReady() (bool, *bootError) {
+	machine := newBootMachine(time.Now())
 
-			if regexp.MustCompile(`^.*boot: No bootable app partitions in the partition table.*$`).MatchString(line) {
-				board.validFirmware = false
-				board.validPrerequisites = false
-				notify("invalidFirmware", "")
-				return false
-			}
+	for !machine.done() {
+		line, ok := board.readLineOrPrompt(machine.deadline)
+		if !ok {
+			machine.expire(time.Now())
+			continue
+		}
 
-			if regexp.MustCompile(`^Falling back to built-in command interpreter.$`).MatchString(line) {
-				failingBack = failingBack + 1
-				if failingBack > 4 {
-					board.validFirmware = false
-					board.validPrerequisites = false
-					notify("invalidFirmware", "")
-					return false
-				}
-			}
+		if !machine.feed(line, time.Now()) {
+			continue
+		}
 
-			if regexp.MustCompile(`^flash read err,.*$`).MatchString(line) {
-				failingBack = failingBack + 1
-				if failingBack > 4 {
-					board.validFirmware = false
-					board.validPrerequisites = false
-					notify("invalidFirmware", "")
-					return false
-				}
-			}
+		log.Println("board boot state: " + machine.state.String())
 
-			if !booting {
-				if (vendorId == 0x1a86) && (productId == 0x7523) {
-					booting = regexp.MustCompile(`Booting Lua RTOS...`).MatchString(line)
-				} else {
-					booting = regexp.MustCompile(`^rst:.*\(POWERON_RESET\),boot:.*(.*)$`).MatchString(line)
-					if !booting {
-						booting = regexp.MustCompile(`^rst:.*\(RTCWDT_RTC_RESET\),boot:.*(.*)$`).MatchString(line)
-					}
-				}
-			} else {
-				if !whitecat {
-					if (vendorId != 0x1a86) || (productId != 0x7523) {
-						whitecat = regexp.MustCompile(`Booting Lua RTOS...`).MatchString(line)
-					} else {
-						whitecat = true
-					}
-					if whitecat {
-						// Send Ctrl-D
-						board.port.Write([]byte{4})
-					}
-					board.consoleOut = true
-				} else {
-					if regexp.MustCompile(`^Lua RTOS-boot-scripts-aborted-ESP32$`).MatchString(line) {
-						return true
-					}
-				}
-			}
+		switch machine.state {
+		case bootFormatting:
+			log.Println("board is formatting the file system")
+			notify("boardUpdate", "Board is formatting the file system, please, wait ...")
+
+		case bootLuaRTOS:
+			// Send Ctrl-D
+			board.port.Write([]byte{4})
+			board.consoleOut = true
+
+		case bootScriptsAborted:
+			// Ask for a new prompt, it can be printed before the boot messages
+			board.port.Write([]byte("\r\n"))
 		}
 	}
+
+	if err := machine.err(); err != nil {
+		if err.invalidFirmware() {
+			board.validFirmware = false
+			board.validPrerequisites = false
+			notifyBootFailed(err)
+			notify("invalidFirmware", "")
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
 }
 
 // Test if line corresponds to Lua RTOS prompt
@@ -620,6 +662,10 @@ func (board *Board) reset(prerequisites bool) {
 	board.consume()
 
 	board.shell = false
+	board.runs.reset()
+	if board.telemetry != nil {
+		board.telemetry.reset()
+	}
 	prevInfo := board.info
 	board.info = ""
 
@@ -627,24 +673,7 @@ func (board *Board) reset(prerequisites bool) {
 	board.consoleIn = true
 
 	// Reset board
-	options := serial.RawOptions
-	options.BitRate = 115200
-	options.Mode = serial.MODE_READ_WRITE
-
-	options.RTS = serial.RTS_OFF
-	board.port.Apply(&options)
-
-	time.Sleep(time.Millisecond * 10)
-
-	options.RTS = serial.RTS_ON
-	board.port.Apply(&options)
-
-	time.Sleep(time.Millisecond * 10)
-
-	options.RTS = serial.RTS_OFF
-	board.port.Apply(&options)
-
-	if !board.waitForReady() {
+	if !board.resetUntilReady() {
 		return
 	}
 
@@ -652,24 +681,10 @@ func (board *Board) reset(prerequisites bool) {
 
 	log.Println("board is ready ...")
 
-	if runtime.GOOS != "linux" {
-		if board.maxBauds != 115200 {
-			log.Println("changing baud rate to " + strconv.Itoa(board.maxBauds) + " ...")
-
-			board.consoleOut = false
-			board.consoleIn = true
-
-			board.port.Write([]byte("uart.attach(uart.UART0, " + strconv.Itoa(board.maxBauds) + ", 8, uart.PARNONE, uart.STOP1)\r\n"))
-			time.Sleep(time.Millisecond * 10)
-			options.BitRate = board.maxBauds
-			board.port.Apply(&options)
-			time.Sleep(time.Millisecond * 10)
-			board.consume()
+	board.negotiateBauds()
 
-			board.consoleOut = false
-			board.consoleIn = true
-		}
-	}
+	board.consoleOut = false
+	board.consoleIn = true
 
 	if prerequisites {
 		notify("boardUpdate", "Downloading prerequisites")
@@ -733,9 +748,9 @@ func (board *Board) reset(prerequisites bool) {
 
 		if prerequisitesSource == NoSource {
 			// Check if we can use prerrequisites installed on the board
-			exists = board.sendCommand("do local att = io.attributes(\"_info.lua\"); print(att ~= nil and att.type == \"file\"); end")
+			exists = board.sendCommand(luaWithAttributes("_info.lua", "print(att ~= nil and att.type == \"file\");"))
 			if exists == "true" {
-				exists = board.sendCommand("do local att = io.attributes(\"/lib/lua/block.lua\"); print(att ~= nil and att.type == \"file\"); end")
+				exists = board.sendCommand(luaWithAttributes("/lib/lua/block.lua", "print(att ~= nil and att.type == \"file\");"))
 				if exists == "true" {
 					prerequisitesSource = BoardSource
 					log.Println("using prerequisites installed on board")
@@ -769,18 +784,18 @@ func (board *Board) reset(prerequisites bool) {
 		// Test for lib/lua
 		if prerequisitesSource != BoardSource {
 			board.timeout(1000)
-			exists = board.sendCommand("do local att = io.attributes(\"/lib\"); print(att ~= nil and att.type == \"directory\"); end")
+			exists = board.sendCommand(luaWithAttributes("/lib", "print(att ~= nil and att.type == \"directory\");"))
 			if exists != "true" {
 				log.Println("creating /lib folder")
-				board.sendCommand("os.mkdir(\"/lib\")")
+				board.sendCommand(luaCall("os.mkdir", "/lib"))
 			} else {
 				log.Println("/lib folder, present")
 			}
 
-			exists = board.sendCommand("do local att = io.attributes(\"/lib/lua\"); print(att ~= nil and att.type == \"directory\"); end")
+			exists = board.sendCommand(luaWithAttributes("/lib/lua", "print(att ~= nil and att.type == \"directory\");"))
 			if exists != "true" {
 				log.Println("creating /lib/lua folder")
-				board.sendCommand("os.mkdir(\"/lib/lua\")")
+				board.sendCommand(luaCall("os.mkdir", "/lib/lua"))
 			} else {
 				log.Println("/lib/lua folder, present")
 			}
@@ -821,6 +836,12 @@ func (board *Board) reset(prerequisites bool) {
 			} else {
 				panic(err)
 			}
+
+			// Helpers of the agent
+			if board.writeFile(evalHelperFile, []byte(evalHelper)) == "" {
+				panic(errors.New("timeout"))
+			}
+			board.evalHelper = true
 		}
 
 		board.consoleOut = true
@@ -841,9 +862,19 @@ func (board *Board) reset(prerequisites bool) {
 		board.subtype = boardInfo.Subtype
 		board.brand = boardInfo.Brand
 		board.ota = boardInfo.Ota
+		board.commit = boardInfo.Commit
 
 		board.shell = boardInfo.Status.Shell
 
+		board.chip = board.getChipInfo()
+		board.consoleOut = true
+
+		board.inventoryKey = Inventory.seen(board, &boardInfo)
+		if entry, ok := Inventory.get(board.inventoryKey); ok {
+			// Values read from the board win over the stored ones
+			board.chip.merge(entry.Chip)
+		}
+
 		firmware := ""
 
 		if board.brand != "" {
@@ -902,7 +933,7 @@ func (board *Board) getDirContent(path string) string {
 	board.consoleIn = true
 
 	board.timeout(1000)
-	response := board.sendCommand("os.ls(\"" + path + "\")")
+	response := board.sendCommand(luaCall("os.ls", path))
 	for _, line := range strings.Split(response, "\n") {
 		element := strings.Split(strings.Replace(line, "\r", "", -1), "\t")
 
@@ -912,10 +943,10 @@ func (board *Board) getDirContent(path string) string {
 			}
 
 			content = content + "{" +
-				"\"type\": \"" + element[0] + "\"," +
-				"\"size\": \"" + element[1] + "\"," +
-				"\"date\": \"" + element[2] + "\"," +
-				"\"name\": \"" + element[3] + "\"" +
+				"\"type\": " + jsonString(element[0]) + "," +
+				"\"size\": " + jsonString(element[1]) + "," +
+				"\"date\": " + jsonString(element[2]) + "," +
+				"\"name\": " + jsonString(element[3]) +
 				"}"
 		}
 	}
@@ -925,14 +956,9 @@ func (board *Board) getDirContent(path string) string {
 	return "[" + content + "]"
 }
 
-func (board *Board) removeFile(path string) {
-	board.consoleOut = false
-	board.consoleIn = true
-	board.timeout(2000)
-	board.sendCommand("os.remove(\"" + path + "\")")
-	board.noTimeout()
-	board.consoleOut = true
-	board.consoleIn = false
+// Remove a file, or an empty folder
+func (board *Board) removeFile(path string) error {
+	return board.fsCommand(fsCall("os.remove", path), fsTimeout)
 }
 
 func (board *Board) writeFile(path string, buffer []byte) string {
@@ -949,47 +975,23 @@ func (board *Board) writeFile(path string, buffer []byte) string {
 	board.consoleOut = false
 	board.consoleIn = true
 
-	writeCommand := "io.receive(\"" + path + "\")"
-
-	outLen := 0
-	outIndex := 0
+	writeCommand := luaCall("io.receive", path)
 
 	board.consume()
 
 	// Send command and test for echo
 	board.port.Write([]byte(writeCommand + "\r"))
 	if board.readLineCR() == writeCommand {
-		for {
-			// Wait for chunk
-			if board.readLineCRLF() == "C" {
-				// Get chunk length
-				if outIndex < len(buffer) {
-					if outIndex+board.chunkSize < len(buffer) {
-						outLen = board.chunkSize
-					} else {
-						outLen = len(buffer) - outIndex
-					}
-				} else {
-					outLen = 0
-				}
-
-				// Send chunk length
-				board.port.Write([]byte{byte(outLen)})
-
-				if outLen > 0 {
-					// Send chunk
-					board.port.Write(buffer[outIndex : outIndex+outLen])
-				} else {
-					break
-				}
-
-				outIndex = outIndex + outLen
-			}
-		}
+		board.sendChunks(buffer, nil)
 
 		if board.readLineCRLF() == "true" {
 			board.consume()
 
+			// Keep the source only if it is in the board
+			if strings.HasSuffix(path, ".lua") {
+				board.sources.set(path, buffer)
+			}
+
 			return "ok"
 		}
 	}
@@ -997,28 +999,13 @@ func (board *Board) writeFile(path string, buffer []byte) string {
 	return ""
 }
 
-func (board *Board) runCode(buffer []byte) {
-	var prevShell string = "false"
-	writeCommand := "os.run()"
-
+// Send a buffer to the board using the chunk protocol. The board asks for each
+// chunk with a "C" line, and the agent answers with the chunk length followed
+// by the chunk. A zero length chunk ends the transfer.
+func (board *Board) sendChunks(buffer []byte, progress func(sent int)) {
 	outLen := 0
 	outIndex := 0
 
-	board.consoleOut = false
-	board.consoleIn = true
-
-	if board.shell {
-		prevShell = "true"
-	}
-
-	// Disable shell
-	if board.info != "" {
-		board.port.Write([]byte("os.shell(false)\r\n"))
-		board.consume()
-	}
-
-	// Send command
-	board.port.Write([]byte(writeCommand + "\r"))
 	for {
 		// Wait for chunk
 		if board.readLineCRLF() == "C" {
@@ -1044,8 +1031,39 @@ func (board *Board) runCode(buffer []byte) {
 			}
 
 			outIndex = outIndex + outLen
+
+			if progress != nil {
+				progress(outIndex)
+			}
 		}
 	}
+}
+
+// Run code in RAM. If not nil, started is called when the code is sent.
+func (board *Board) runCode(buffer []byte, started func()) {
+	var prevShell string = "false"
+	writeCommand := "os.run()"
+
+	board.consoleOut = false
+	board.consoleIn = true
+
+	if board.shell {
+		prevShell = "true"
+	}
+
+	// Disable shell
+	if board.info != "" {
+		board.port.Write([]byte("os.shell(false)\r\n"))
+		board.consume()
+	}
+
+	// Send command
+	board.port.Write([]byte(writeCommand + "\r"))
+	board.sendChunks(buffer, nil)
+
+	if started != nil {
+		started()
+	}
 
 	board.consume()
 
@@ -1078,7 +1096,7 @@ func (board *Board) readFile(path string) []byte {
 	board.consoleIn = true
 
 	// Command for read file
-	readCommand := "io.send(\"" + path + "\")"
+	readCommand := luaCall("io.send", path)
 
 	// Send command and test for echo
 	board.port.Write([]byte(readCommand + "\r"))
@@ -1105,14 +1123,30 @@ func (board *Board) readFile(path string) []byte {
 
 		board.consume()
 
-		return buffer.Bytes()
+		// Not nil, even for an empty file
+		return append([]byte{}, buffer.Bytes()...)
 	}
 
 	return nil
 }
 
-func (board *Board) runProgram(path string, code []byte) {
-	var prevShell string = "false"
+// Run a program, and get the run id. In ephemeral mode the program is run in
+// RAM, in file mode the program is written to path and run, and in autorun
+// mode autorun.lua is also updated for run the program at boot. If the
+// program has syntax errors, or can't be written, it is not run, and the run
+// id is 0.
+func (board *Board) runProgram(path string, code []byte, mode string) (int, error) {
+	if err := board.checkLua(path, code); err != nil {
+		return 0, err
+	}
+
+	board.resetForRun()
+
+	return board.startProgram(path, code, mode)
+}
+
+// Reset the board, for stop the running program before run a new one
+func (board *Board) resetForRun() {
 	board.disableInspectorBootNotify = true
 
 	board.consoleOut = false
@@ -1120,10 +1154,54 @@ func (board *Board) runProgram(path string, code []byte) {
 	// Reset board
 	board.reset(false)
 	board.disableInspectorBootNotify = false
+	board.luaErrors.clearBlocks()
+	board.profiler.reset()
+}
+
+// Start a program, once the board is reset
+func (board *Board) startProgram(path string, code []byte, mode string) (id int, err error) {
+	var prevShell string = "false"
+
+	defer func() {
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			id = 0
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if mode != runEphemeral && mode != runFile {
+		mode = runAutorun
+	}
 
 	board.consoleOut = false
 	board.consoleIn = true
 
+	if mode == runEphemeral {
+		var run *ProgramRun
+
+		board.runCode(append([]byte("require(\"block\");wcBlock.delevepMode=true;"), code...), func() {
+			run = board.runs.start(path)
+		})
+
+		if run == nil {
+			return 0, errors.New("can't run " + path)
+		}
+
+		return run.Id, nil
+	}
+
+	if mode == runAutorun {
+		if err := board.backupAutorun(); err != nil {
+			return 0, err
+		}
+
+		board.consoleOut = false
+		board.consoleIn = true
+	}
+
 	if board.shell {
 		prevShell = "true"
 	}
@@ -1134,26 +1212,34 @@ func (board *Board) runProgram(path string, code []byte) {
 		board.consume()
 	}
 
+	// Reenable shell when finished
+	defer func() {
+		if board.info != "" {
+			board.consoleOut = false
+			board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
+			board.consume()
+		}
+	}()
+
 	// First update autorun.lua, which run the target file
-	board.writeFile("/autorun.lua", []byte("dofile(\""+path+"\")\r\n"))
+	if mode == runAutorun {
+		if board.writeFile(autorunFile, agentAutorun(path)) == "" {
+			return 0, errors.New("can't write " + autorunFile)
+		}
+	}
 
 	// Now write code to target file
-	board.writeFile(path, code)
+	if board.uploadFile(path, code) == "" {
+		return 0, errors.New("can't write " + path)
+	}
 
 	// Run the target file
-	board.port.Write([]byte("require(\"block\");wcBlock.delevepMode=true;dofile(\"" + path + "\")\r"))
+	run := board.runs.start(path)
+	board.port.Write([]byte("require(\"block\");wcBlock.delevepMode=true;" + luaCall("dofile", path) + "\r"))
 
 	board.consume()
 
-	// Reenable shell
-	if board.info != "" {
-		board.consoleOut = false
-		board.port.Write([]byte("os.shell(" + prevShell + ")\r\n"))
-		board.consume()
-	}
-
-	board.consoleOut = true
-	board.consoleIn = false
+	return run.Id, nil
 }
 
 func (board *Board) runCommand(code []byte) string {
@@ -1178,17 +1264,17 @@ func exec_cmd(cmd string, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func (board *Board) flash(argument_file string) {
-	var out string = ""
+// Flash the images of a firmware folder, using the arguments in argument_file
+func (board *Board) flash(folder string, argument_file string) error {
 	var re *regexp.Regexp
 
 	// Read flash arguments
-	b, err := ioutil.ReadFile(AppDataTmpFolder + "/firmware_files/" + argument_file)
+	b, err := ioutil.ReadFile(folder + "/" + argument_file)
 	if err != nil {
 		notify("boardUpdate", err.Error())
 		time.Sleep(time.Millisecond * 1000)
 		Upgrading = false
-		return
+		return err
 	}
 
 	flash_args := string(b)
@@ -1199,13 +1285,10 @@ func (board *Board) flash(argument_file string) {
 	for _, arg := range args {
 		re = regexp.MustCompile(`^.*\.bin$`)
 		if re.MatchString(arg) {
-			flash_args = strings.Replace(flash_args, arg, "\""+AppDataTmpFolder+"/firmware_files/"+arg+"\"", -1)
+			flash_args = strings.Replace(flash_args, arg, "\""+folder+"/"+arg+"\"", -1)
 		}
 	}
 
-	// Add usb port to flash arguments
-	flash_args = "--port " + board.dev + " " + flash_args
-
 	log.Println("flash args: ", flash_args)
 
 	// Build the flash command
@@ -1215,6 +1298,18 @@ func (board *Board) flash(argument_file string) {
 		cmdArgs[i] = strings.Replace(cmdArgs[i], "\"", "", -1)
 	}
 
+	return board.esptool(cmdArgs...)
+}
+
+// Run esptool on the board's port. The esptool output is sent to the IDE
+// for show the progress.
+func (board *Board) esptool(args ...string) error {
+	var out string = ""
+	var chip ChipInfo
+
+	// Add usb port to arguments
+	cmdArgs := append([]string{"--port", board.dev}, args...)
+
 	for _, v := range cmdArgs {
 		fmt.Println(v)
 	}
@@ -1228,7 +1323,9 @@ func (board *Board) flash(argument_file string) {
 	stdout, _ := cmd.StdoutPipe()
 
 	// Start
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
 	// Read stdout until EOF
 	c := make([]byte, 1)
@@ -1241,6 +1338,7 @@ func (board *Board) flash(argument_file string) {
 		if c[0] == '\r' || c[0] == '\n' {
 			out = strings.Replace(out, "...", "", -1)
 			if out != "" {
+				chip.parseEsptool(out)
 				notify("boardUpdate", out)
 			}
 			out = ""
@@ -1248,6 +1346,13 @@ func (board *Board) flash(argument_file string) {
 			out = out + string(c)
 		}
 	}
+
+	if !chip.empty() {
+		board.chip.merge(chip)
+		Inventory.flashed(board, chip)
+	}
+
+	return cmd.Wait()
 }
 
 func (board *Board) upgrade(install bool, firmware string) {
@@ -1279,10 +1384,10 @@ func (board *Board) upgrade(install bool, firmware string) {
 		return
 	}
 
-	board.flash("flash_args")
+	board.flash(AppDataTmpFolder+"/firmware_files", "flash_args")
 
 	if install {
-		board.flash("flashfs_args")
+		board.flash(AppDataTmpFolder+"/firmware_files", "flashfs_args")
 	}
 
 	log.Println("Upgraded")
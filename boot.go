@@ -0,0 +1,262 @@
+/*
+ * Whitecat Blocky Environment, board boot sequence
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Boot states
+type bootState int
+
+const (
+	bootResetting bootState = iota
+	bootBootloader
+	bootLuaRTOS
+	bootFormatting
+	bootScriptsAborted
+	bootPrompt
+	bootFailed
+)
+
+var bootStateNames = map[bootState]string{
+	bootResetting:      "resetting",
+	bootBootloader:     "bootloader",
+	bootLuaRTOS:        "booting",
+	bootFormatting:     "formatting",
+	bootScriptsAborted: "scriptsAborted",
+	bootPrompt:         "prompt",
+	bootFailed:         "failed",
+}
+
+func (state bootState) String() string {
+	return bootStateNames[state]
+}
+
+// Boot failure reasons
+const (
+	bootNoBanner          = "noBootBanner"
+	bootInvalidAppImage   = "invalidAppImage"
+	bootFlashReadError    = "flashReadError"
+	bootFormattingFS      = "formattingFS"
+	bootStuckInBootloader = "stuckInBootloader"
+	bootScriptsNotAborted = "scriptsNotAborted"
+	bootNoPrompt          = "noPrompt"
+)
+
+// Timeout of each state
+var bootTimeouts = map[bootState]time.Duration{
+	bootResetting:      4 * time.Second,
+	bootBootloader:     4 * time.Second,
+	bootLuaRTOS:        10 * time.Second,
+	bootFormatting:     120 * time.Second,
+	bootScriptsAborted: 3 * time.Second,
+}
+
+// Reason of a timeout in each state
+var bootTimeoutReasons = map[bootState]string{
+	bootResetting:      bootNoBanner,
+	bootBootloader:     bootStuckInBootloader,
+	bootLuaRTOS:        bootScriptsNotAborted,
+	bootFormatting:     bootFormattingFS,
+	bootScriptsAborted: bootNoPrompt,
+}
+
+// Max number of repeated errors before fail
+const bootMaxRetries = 4
+
+// Number of boot log lines kept for report failures
+const bootLogLines = 30
+
+var (
+	bootResetRe        = regexp.MustCompile(`^rst:.*,boot:`)
+	bootDownloadRe     = regexp.MustCompile(`^waiting for download`)
+	bootLuaRTOSRe      = regexp.MustCompile(`Booting Lua RTOS...`)
+	bootAbortedRe      = regexp.MustCompile(`^Lua RTOS-boot-scripts-aborted-ESP32$`)
+	bootPromptRe       = regexp.MustCompile(`^/[^>]*> ?`)
+	bootFormattingRe   = regexp.MustCompile(`^.*(formatting|formating)\s{0,1}\.\.\.$`)
+	bootInvalidImageRe = regexp.MustCompile(`^.*boot: (Failed to verify app image|No bootable app partitions in the partition table).*$`)
+	bootFallingBackRe  = regexp.MustCompile(`^Falling back to built-in command interpreter.$`)
+	bootFlashReadErrRe = regexp.MustCompile(`^flash read err,.*$`)
+)
+
+// A boot failure
+type bootError struct {
+	Reason string `json:"reason"`
+	State  string `json:"state"`
+	Log    string `json:"log"`
+}
+
+func (err *bootError) Error() string {
+	return "boot failed in " + err.State + " state: " + err.Reason
+}
+
+// Board can boot if it's reset in other way
+func (err *bootError) retryable() bool {
+	return err.Reason == bootNoBanner || err.Reason == bootStuckInBootloader
+}
+
+// Board has an invalid firmware
+func (err *bootError) invalidFirmware() bool {
+	return err.Reason == bootInvalidAppImage || err.Reason == bootFlashReadError
+}
+
+// Boot sequence state machine:
+//
+// resetting -> bootloader -> booting -> (formatting) -> scriptsAborted -> prompt
+//
+// Each state has its own timeout. The machine is fed with the lines received
+// from the board.
+type bootMachine struct {
+	state    bootState
+	deadline time.Time
+
+	// State before fail
+	failedState bootState
+	reason      string
+
+	fallingBack int
+	flashErrors int
+
+	log []string
+}
+
+func newBootMachine(now time.Time) *bootMachine {
+	machine := &bootMachine{}
+	machine.enter(bootResetting, now)
+
+	return machine
+}
+
+func (machine *bootMachine) enter(state bootState, now time.Time) {
+	machine.state = state
+	machine.deadline = now.Add(bootTimeouts[state])
+}
+
+func (machine *bootMachine) fail(reason string) {
+	machine.failedState = machine.state
+	machine.reason = reason
+	machine.state = bootFailed
+}
+
+// Is the boot sequence finished?
+func (machine *bootMachine) done() bool {
+	return machine.state == bootPrompt || machine.state == bootFailed
+}
+
+// Get the failure, or nil if boot has not failed
+func (machine *bootMachine) err() *bootError {
+	if machine.state != bootFailed {
+		return nil
+	}
+
+	return &bootError{
+		Reason: machine.reason,
+		State:  machine.failedState.String(),
+		Log:    base64.StdEncoding.EncodeToString([]byte(strings.Join(machine.log, "\n"))),
+	}
+}
+
+// Test the state timeout. Returns true if boot has failed.
+func (machine *bootMachine) expire(now time.Time) bool {
+	if !machine.done() && now.After(machine.deadline) {
+		machine.fail(bootTimeoutReasons[machine.state])
+	}
+
+	return machine.state == bootFailed
+}
+
+// Feed a line received from the board. Returns true if the state has changed.
+func (machine *bootMachine) feed(line string, now time.Time) bool {
+	if machine.done() {
+		return false
+	}
+
+	machine.log = append(machine.log, line)
+	if len(machine.log) > bootLogLines {
+		machine.log = machine.log[1:]
+	}
+
+	prev := machine.state
+
+	// Failures, in any state
+	switch {
+	case bootInvalidImageRe.MatchString(line):
+		machine.fail(bootInvalidAppImage)
+	case bootFallingBackRe.MatchString(line):
+		machine.fallingBack++
+		if machine.fallingBack > bootMaxRetries {
+			machine.fail(bootInvalidAppImage)
+		}
+	case bootFlashReadErrRe.MatchString(line):
+		machine.flashErrors++
+		if machine.flashErrors > bootMaxRetries {
+			machine.fail(bootFlashReadError)
+		}
+	case bootDownloadRe.MatchString(line):
+		machine.fail(bootStuckInBootloader)
+	}
+
+	if machine.state == bootFailed {
+		return true
+	}
+
+	switch machine.state {
+	case bootResetting:
+		if bootResetRe.MatchString(line) {
+			machine.enter(bootBootloader, now)
+		} else if bootLuaRTOSRe.MatchString(line) {
+			// Some adapters miss the bootloader messages
+			machine.enter(bootLuaRTOS, now)
+		}
+
+	case bootBootloader:
+		if bootLuaRTOSRe.MatchString(line) {
+			machine.enter(bootLuaRTOS, now)
+		}
+
+	case bootLuaRTOS, bootFormatting:
+		if bootFormattingRe.MatchString(line) {
+			machine.enter(bootFormatting, now)
+		} else if bootAbortedRe.MatchString(line) {
+			machine.enter(bootScriptsAborted, now)
+		}
+
+	case bootScriptsAborted:
+		if bootPromptRe.MatchString(line) {
+			machine.enter(bootPrompt, now)
+		}
+	}
+
+	return machine.state != prev
+}
@@ -0,0 +1,135 @@
+/*
+ * Whitecat Blocky Environment, boot state machine tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Feed a recorded boot log to a boot machine, and expire it after wait
+func feedBootLog(t *testing.T, file string, wait time.Duration) *bootMachine {
+	log, err := ioutil.ReadFile(filepath.Join("testdata", "boot", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(0, 0)
+	machine := newBootMachine(now)
+
+	for _, line := range strings.Split(string(log), "\n") {
+		now = now.Add(10 * time.Millisecond)
+		machine.feed(strings.TrimRight(line, "\r"), now)
+	}
+
+	if wait > 0 {
+		machine.expire(now.Add(wait))
+	}
+
+	return machine
+}
+
+func TestBootMachine(t *testing.T) {
+	tests := []struct {
+		log    string
+		wait   time.Duration
+		state  bootState
+		reason string
+	}{
+		{"prompt.log", 0, bootPrompt, ""},
+		{"nobanner.log", 5 * time.Second, bootFailed, bootNoBanner},
+		{"invalidimage.log", 0, bootFailed, bootInvalidAppImage},
+		{"flashreaderr.log", 0, bootFailed, bootFlashReadError},
+		{"formatting.log", 121 * time.Second, bootFailed, bootFormattingFS},
+		{"download.log", 0, bootFailed, bootStuckInBootloader},
+		{"bootloader.log", 5 * time.Second, bootFailed, bootStuckInBootloader},
+		{"noprompt.log", 4 * time.Second, bootFailed, bootNoPrompt},
+	}
+
+	for _, test := range tests {
+		machine := feedBootLog(t, test.log, test.wait)
+
+		if machine.state != test.state {
+			t.Errorf("%s: state is %s, expected %s", test.log, machine.state, test.state)
+			continue
+		}
+
+		err := machine.err()
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.log, err)
+			}
+			continue
+		}
+
+		if err == nil || err.Reason != test.reason {
+			t.Errorf("%s: error is %v, expected %s", test.log, err, test.reason)
+		}
+	}
+}
+
+func TestBootMachineFormattingExtendsTimeout(t *testing.T) {
+	machine := feedBootLog(t, "formatting.log", 0)
+
+	if machine.state != bootFormatting {
+		t.Fatalf("state is %s, expected %s", machine.state, bootFormatting)
+	}
+
+	// The Lua RTOS timeout doesn't apply while formatting
+	if machine.expire(time.Unix(0, 0).Add(60 * time.Second)) {
+		t.Errorf("boot failed while formatting: %v", machine.err())
+	}
+}
+
+func TestBootMachineStates(t *testing.T) {
+	now := time.Unix(0, 0)
+	machine := newBootMachine(now)
+
+	steps := []struct {
+		line  string
+		state bootState
+	}{
+		{"rst:0x1 (POWERON_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)", bootBootloader},
+		{"Booting Lua RTOS...", bootLuaRTOS},
+		{"Lua RTOS-boot-scripts-aborted-ESP32", bootScriptsAborted},
+		{"/ > ", bootPrompt},
+	}
+
+	for _, step := range steps {
+		machine.feed(step.line, now)
+
+		if machine.state != step.state {
+			t.Fatalf("after %q state is %s, expected %s", step.line, machine.state, step.state)
+		}
+	}
+}
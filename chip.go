@@ -0,0 +1,187 @@
+/*
+ * Whitecat Blocky Environment, chip information
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Information about the chip of a board. Is got from the ROM bootloader when
+// flashing, or from the running firmware. Fields that are unknown are empty.
+type ChipInfo struct {
+	Chip      string `json:"chip"`
+	Revision  string `json:"revision"`
+	Crystal   string `json:"crystal"`
+	Mac       string `json:"mac"`
+	FlashSize string `json:"flashSize"`
+}
+
+// Lines printed by esptool when it connects to the ROM bootloader
+var esptoolChipRe = []struct {
+	re    *regexp.Regexp
+	field func(info *ChipInfo) *string
+}{
+	{regexp.MustCompile(`^Chip is (\S+)`), func(info *ChipInfo) *string { return &info.Chip }},
+	{regexp.MustCompile(`^Crystal is (\d+MHz)`), func(info *ChipInfo) *string { return &info.Crystal }},
+	{regexp.MustCompile(`^MAC: ([0-9a-fA-F:]+)`), func(info *ChipInfo) *string { return &info.Mac }},
+	{regexp.MustCompile(`^(?i)(?:Auto-detected|Detected) flash size: (\S+)`), func(info *ChipInfo) *string { return &info.FlashSize }},
+}
+
+var chipRevisionRe = regexp.MustCompile(`\(revision (?:v)?([0-9.]+)\)`)
+
+// Parse a line of the esptool output
+func (info *ChipInfo) parseEsptool(line string) {
+	line = strings.TrimSpace(line)
+
+	for _, chipRe := range esptoolChipRe {
+		if match := chipRe.re.FindStringSubmatch(line); match != nil {
+			*chipRe.field(info) = match[1]
+		}
+	}
+
+	if strings.HasPrefix(line, "Chip is") {
+		if match := chipRevisionRe.FindStringSubmatch(line); match != nil {
+			info.Revision = match[1]
+		}
+	}
+
+	info.Mac = normalizeMac(info.Mac)
+}
+
+// Fill the unknown fields with the fields of other
+func (info *ChipInfo) merge(other ChipInfo) {
+	if info.Chip == "" {
+		info.Chip = other.Chip
+	}
+
+	if info.Revision == "" {
+		info.Revision = other.Revision
+	}
+
+	if info.Crystal == "" {
+		info.Crystal = other.Crystal
+	}
+
+	if info.Mac == "" {
+		info.Mac = other.Mac
+	}
+
+	if info.FlashSize == "" {
+		info.FlashSize = other.FlashSize
+	}
+}
+
+func (info ChipInfo) empty() bool {
+	return info == ChipInfo{}
+}
+
+// Normalize a MAC address to the xx:xx:xx:xx:xx:xx form. Returns an empty
+// string if mac is not a valid MAC address.
+func normalizeMac(mac string) string {
+	hex := strings.ToLower(regexp.MustCompile(`[^0-9a-fA-F]`).ReplaceAllString(mac, ""))
+	if len(hex) != 12 {
+		return ""
+	}
+
+	var parts []string
+
+	for i := 0; i < 12; i = i + 2 {
+		parts = append(parts, hex[i:i+2])
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// Board side helper that prints the chip information known by the firmware as
+// a JSON object
+const chipInfoHelper = `
+_wcc_chip = function()
+	local function call(f, ...)
+		if type(f) ~= "function" then return nil end
+		local ok, v = pcall(f, ...)
+		if ok then return v end
+	end
+
+	local function str(v)
+		if v == nil then return "\"\"" end
+		return string.format("%q", tostring(v))
+	end
+
+	local mac = nil
+	local ifaces = call(net and net.stat, true)
+	if type(ifaces) == "table" then
+		for _, iface in pairs(ifaces) do
+			if type(iface) == "table" and iface.mac and iface.mac ~= "" then
+				mac = iface.mac
+				break
+			end
+		end
+	end
+
+	print("{" ..
+		"\"chip\": " .. str(call(cpu and cpu.model)) .. ", " ..
+		"\"revision\": " .. str(call(cpu and cpu.revision)) .. ", " ..
+		"\"mac\": " .. str(mac) ..
+	"}")
+end
+`
+
+// Get the chip information known by the running firmware. The information is
+// optional, so if the firmware doesn't answer the information is empty.
+func (board *Board) getChipInfo() (info ChipInfo) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			log.Println("can't get chip information:", r)
+			info = ChipInfo{}
+		}
+	}()
+
+	board.runCode([]byte(chipInfoHelper), nil)
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(2000)
+	response := board.sendCommand("_wcc_chip()")
+
+	lines := strings.Split(strings.TrimSpace(response), "\n")
+
+	json.Unmarshal([]byte(strings.TrimSpace(lines[len(lines)-1])), &info)
+
+	info.Mac = normalizeMac(info.Mac)
+
+	return info
+}
@@ -0,0 +1,292 @@
+/*
+ * Whitecat Blocky Environment, command line commands
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Time to wait for a board in commands that need it
+const cliAttachTimeout = 60 * time.Second
+
+func isCliCommand(command string) bool {
+	switch command {
+	case "inventory", "partitions", "provision", "test":
+		return true
+	}
+
+	return false
+}
+
+func cliUsage() {
+	fmt.Println("commands:")
+	fmt.Println("")
+	fmt.Println(" inventory [list]                 : list known boards")
+	fmt.Println(" inventory set key name [notes]   : set the name and notes of a board")
+	fmt.Println(" inventory remove key             : remove a board")
+	fmt.Println(" partitions file                  : show a partition table (.bin or .csv)")
+	fmt.Println(" partitions convert file.csv out  : convert a partition table to binary")
+	fmt.Println(" provision job.json               : provision the boards that are plugged in")
+	fmt.Println(" test [options] folder            : run the Lua tests of a folder on the board")
+	fmt.Println("   -o file                        : JUnit XML report file (default test-results.xml)")
+	fmt.Println("   -t ms                          : timeout of each test file (default 30000)")
+	fmt.Println("   -p port                        : serial port of the board (default, the first known USB-UART)")
+}
+
+// Run a command, and get the exit code
+func runCli(command string, args []string) int {
+	switch command {
+	case "inventory":
+		return cliInventory(args)
+	case "partitions":
+		return cliPartitions(args)
+	case "provision":
+		return cliProvision(args)
+	case "test":
+		return cliTest(args)
+	}
+
+	cliUsage()
+	return 1
+}
+
+func cliInventory(args []string) int {
+	if len(args) == 0 || args[0] == "list" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintln(w, "KEY\tNAME\tMODEL\tFIRMWARE\tLAST SEEN\tNOTES")
+		for _, entry := range Inventory.list() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Key, entry.Name, entry.Model, entry.Commit, entry.LastSeen.Format("2006-01-02 15:04"), entry.Notes)
+		}
+
+		w.Flush()
+
+		return 0
+	}
+
+	switch args[0] {
+	case "set":
+		if len(args) < 3 || len(args) > 4 {
+			break
+		}
+
+		notes := ""
+		if len(args) == 4 {
+			notes = args[3]
+		} else if entry, ok := Inventory.get(args[1]); ok {
+			notes = entry.Notes
+		}
+
+		if _, err := Inventory.update(args[1], args[2], notes); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		return 0
+
+	case "remove":
+		if len(args) != 2 {
+			break
+		}
+
+		if err := Inventory.remove(args[1]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		return 0
+	}
+
+	cliUsage()
+	return 1
+}
+
+func cliPartitions(args []string) int {
+	switch {
+	case len(args) == 1:
+		partitions, err := readPartitionTable(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintln(w, "LABEL\tTYPE\tSUBTYPE\tOFFSET\tSIZE\tFLAGS")
+		for _, p := range partitions {
+			flags := ""
+			if p.Encrypted {
+				flags = "encrypted"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t0x%x\t%dK\t%s\n", p.Label, p.Type, p.SubType, p.Offset, p.Size/1024, flags)
+		}
+
+		w.Flush()
+
+		return 0
+
+	case len(args) == 3 && args[0] == "convert":
+		partitions, err := readPartitionTable(args[1])
+		if err == nil {
+			var b []byte
+
+			if b, err = encodePartitionTable(partitions); err == nil {
+				err = ioutil.WriteFile(args[2], b, 0666)
+			}
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		return 0
+	}
+
+	cliUsage()
+	return 1
+}
+
+func cliProvision(args []string) int {
+	if len(args) != 1 {
+		cliUsage()
+		return 1
+	}
+
+	job, err := loadProvisioningJob(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	runProvisioning(job, os.Stdout)
+
+	return 0
+}
+
+// True if the agent runs without the IDE
+var Headless = false
+
+// Start the agent without the IDE
+func startHeadless() {
+	Headless = true
+
+	ConsoleUp = make(chan byte, 10*1024)
+	IdeDetach = make(chan bool)
+
+	// Nobody reads the console
+	go func() {
+		for {
+			<-ConsoleUp
+		}
+	}()
+}
+
+// Start the monitor, and wait for a board
+func cliAttach() (*Board, error) {
+	startHeadless()
+
+	go monitor()
+
+	start := time.Now()
+
+	for time.Since(start) < cliAttachTimeout {
+		BoardMutex.Lock()
+		board := connectedBoard
+		BoardMutex.Unlock()
+
+		if board != nil {
+			if !board.validFirmware || !board.validPrerequisites {
+				return nil, errors.New("board is not running a valid firmware")
+			}
+
+			return board, nil
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return nil, errors.New("board not found")
+}
+
+func cliTest(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	report := flags.String("o", "test-results.xml", "")
+	timeout := flags.Int("t", testDefaultTimeout, "")
+	port := flags.String("p", "", "")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		cliUsage()
+		return 2
+	}
+
+	if *port != "" {
+		AgentConfig.DeviceRules = append([]DeviceRule{{Port: *port}}, AgentConfig.DeviceRules...)
+	}
+
+	board, err := cliAttach()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	suites, err := board.runTests(flags.Arg(0), time.Duration(*timeout)*time.Millisecond, func(suite *JUnitTestSuite) {
+		result := "ok"
+		if !suite.passed() {
+			result = "FAIL"
+		}
+
+		fmt.Printf("%-4s %s (%d tests, %d failures, %d errors, %.2fs)\n", result, suite.Name, suite.Tests, suite.Failures, suite.Errors, suite.Time)
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	if err = suites.write(*report); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	if suites.Failures > 0 || suites.Errors > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,160 @@
+/*
+ * Whitecat Blocky Environment, agent configuration
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+The agent configuration is read at startup from config.json, in the user data folder.
+
+Example:
+
+{
+	"InspectorRules": [
+		{"Notification": "boardBrownout", "Match": "^Brownout detector was triggered"},
+		{"Notification": "boardWatchdogReset", "Match": "^rst:.*(TG[01]WDT_SYS_RESET|RTCWDT_SYS_RESET),boot:", "Boot": true},
+		{"Notification": "appLog", "Match": "^\\[app\\] (\\w+): (.*)$", "Fields": [
+			{"Name": "level", "Group": 1},
+			{"Name": "message", "Group": 2, "Base64": true}
+		]}
+	],
+	"DeviceRules": [
+		{"Port": "/dev/ttyUSB3", "Exclude": true},
+		{"VendorId": "0x10c4", "ProductId": "0xea60", "SerialNumber": "0001*", "MaxBauds": 921600, "Reset": "dtr-rts"}
+	],
+	"Telemetry": {"Interval": 10000, "History": 720},
+	"Filesystem": {"Type": "lfs", "Tool": "/opt/lua-rtos/mklittlefs"},
+	"Projects": {"Roots": ["/home/user/whitecat"]},
+	"Upload": {"Minify": true},
+	"Check": {"Globals": true}
+}
+
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// Agent configuration, read from config.json in the user data folder.
+// All settings are optional, and the agent works without a config file.
+type Config struct {
+	// User defined inspector rules, evaluated before the built-in ones
+	InspectorRules []InspectorRule
+
+	// User defined device rules, evaluated before the built-in ones and the
+	// devices requested by the IDE
+	DeviceRules []DeviceRule
+
+	// ELF file of the firmware, used for decode panics. If empty, the ELF file
+	// of the last downloaded firmware is used.
+	FirmwareELF string
+
+	// Board telemetry
+	Telemetry struct {
+		// Poll interval in milliseconds, 0 disables polling
+		Interval int
+
+		// Number of samples kept
+		History int
+
+		// Lua command that prints a sample as a JSON object. If empty, the
+		// agent's helper is used.
+		Command string
+	}
+
+	// Filesystem image builder
+	Filesystem struct {
+		// Filesystem type, spiffs or lfs. If empty, is guessed from the
+		// partition table of the board, or from the firmware.
+		Type string
+
+		// Path of the mkspiffs / mklittlefs tool. If empty, the tool is searched
+		// in the utils folder and in the PATH, and downloaded if not found.
+		Tool string
+
+		// Block and page size, in bytes. If 0, the Lua RTOS defaults are used.
+		BlockSize int
+		PageSize  int
+	}
+
+	// Local projects
+	Projects struct {
+		// Folders with the projects that the IDE can run, flash and
+		// provision. If empty, the projects folder of the user data folder.
+		Roots []string
+	}
+
+	// Upload of Lua sources
+	Upload struct {
+		// Remove comments and white space
+		Minify bool
+
+		// Precompile with luac. The luac must be built for Lua RTOS, and is
+		// taken from Luac, or from the utils folder.
+		Precompile bool
+		Luac       string
+	}
+
+	// Checks of Lua sources before send them to the board. Syntax errors are
+	// always checked, unless the check is disabled.
+	Check struct {
+		// Don't check the sources, the errors are reported by the board
+		Disable bool
+
+		// Warn about globals not defined in the source, nor in the modules
+		// of the firmware
+		Globals bool
+	}
+}
+
+var AgentConfig Config
+
+func loadConfig() {
+	file := path.Join(AppDataFolder, "config.json")
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("can't read config file", err)
+		}
+
+		return
+	}
+
+	if err = json.Unmarshal(b, &AgentConfig); err != nil {
+		log.Println("invalid config file", err)
+		return
+	}
+
+	log.Println("using config file " + file)
+}
@@ -0,0 +1,247 @@
+/*
+ * Whitecat Blocky Environment, device matching rules
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"github.com/mikepb/go-serial"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A rule for match serial ports. A rule matches a port if all the non-empty
+// conditions of the rule match the port.
+type DeviceRule struct {
+	// USB VID and PID, in hex, for example 0x403
+	VendorId  string
+	ProductId string
+
+	// USB serial number, product and port name, glob patterns
+	SerialNumber string
+	Product      string
+	Port         string
+
+	// USB interface number
+	Interface *int
+
+	// If true, matching ports are not used
+	Exclude bool
+
+	// Max bauds for the board, 0 for default
+	MaxBauds int
+
+	// Reset methods for the board (rts, dtr-rts, usb-jtag, none, soft), as a
+	// comma separated list tried in order. Empty for default.
+	Reset string
+}
+
+// A serial port found when scanning ports
+type portInfo struct {
+	info *serial.Info
+
+	name         string
+	vendorId     int
+	productId    int
+	serialNumber string
+	product      string
+
+	// USB interface number, or -1 if unknown
+	iface int
+}
+
+var ftdiJtagInterface = 0
+
+// Built-in rules
+var builtinDeviceRules = []DeviceRule{
+	// FTDI dual interface adapters, such as the ESP-WROVER-KIT, uses the first
+	// interface for JTAG and the second one for the UART
+	{VendorId: "0x403", ProductId: "0x6010", Interface: &ftdiJtagInterface, Exclude: true},
+}
+
+// Rules used without the IDE, when there are not other rules: the USB-UART
+// bridges used in the ESP32 boards
+var headlessDeviceRules = []DeviceRule{
+	{VendorId: "0x10c4", ProductId: "0xea60"}, // CP210x
+	{VendorId: "0x1a86", ProductId: "0x7523"}, // CH340
+	{VendorId: "0x1a86", ProductId: "0x55d4"}, // CH9102
+	{VendorId: "0x403", ProductId: "0x6001"},  // FT232R
+	{VendorId: "0x403", ProductId: "0x6010"},  // FT2232
+	{VendorId: "0x403", ProductId: "0x6014"},  // FT232H
+	{VendorId: "0x403", ProductId: "0x6015"},  // FT231X
+}
+
+// Get the device rules: user defined rules first, then built-in rules, then
+// the devices requested by the IDE, and then the devices of the provisioning
+// job. Without the IDE, and if there are not other rules, the known USB-UART
+// bridges are used.
+func deviceRules() []DeviceRule {
+	var rules []DeviceRule
+
+	jobRules := Provisioning.deviceRules()
+
+	rules = append(rules, AgentConfig.DeviceRules...)
+	rules = append(rules, builtinDeviceRules...)
+
+	for _, device := range devices {
+		maxBauds, _ := strconv.Atoi(device.MaxBauds)
+
+		rules = append(rules, DeviceRule{
+			VendorId:  device.VendorId,
+			ProductId: device.ProductId,
+			MaxBauds:  maxBauds,
+		})
+	}
+
+	rules = append(rules, jobRules...)
+
+	if Headless && len(AgentConfig.DeviceRules) == 0 && len(jobRules) == 0 {
+		rules = append(rules, headlessDeviceRules...)
+	}
+
+	return rules
+}
+
+// Parse an hex id, such as 0x403
+func parseUSBId(id string) (int, bool) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(id), "0x"), 16, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(value), true
+}
+
+func globMatch(pattern string, value string) bool {
+	matched, err := filepath.Match(pattern, value)
+
+	return err == nil && matched
+}
+
+// Test if rule matches port
+func (rule *DeviceRule) matches(port *portInfo) bool {
+	if rule.VendorId != "" {
+		if id, ok := parseUSBId(rule.VendorId); !ok || id != port.vendorId {
+			return false
+		}
+	}
+
+	if rule.ProductId != "" {
+		if id, ok := parseUSBId(rule.ProductId); !ok || id != port.productId {
+			return false
+		}
+	}
+
+	if rule.SerialNumber != "" && !globMatch(rule.SerialNumber, port.serialNumber) {
+		return false
+	}
+
+	if rule.Product != "" && !globMatch(rule.Product, port.product) {
+		return false
+	}
+
+	if rule.Port != "" && !globMatch(rule.Port, port.name) {
+		return false
+	}
+
+	if rule.Interface != nil && *rule.Interface != port.iface {
+		return false
+	}
+
+	return true
+}
+
+// Get the rule that matches port, the first matching rule wins. Returns nil if
+// there is not a matching rule, or port is excluded.
+func matchDeviceRule(rules []DeviceRule, port *portInfo) *DeviceRule {
+	for i := range rules {
+		if rules[i].matches(port) {
+			if rules[i].Exclude {
+				return nil
+			}
+
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Get the USB ports. If the interface number can't be get from the system, the
+// interface number is the order of the port among the ports of the same device.
+func listUSBPorts() ([]*portInfo, error) {
+	var ports []*portInfo
+
+	infos, err := serial.ListPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	ordinals := make(map[string]int)
+
+	for _, info := range infos {
+		// Read VID/PID
+		vendorId, productId, err := info.USBVIDPID()
+		if err != nil {
+			continue
+		}
+
+		// We need a VID / PID
+		if vendorId == 0 || productId == 0 {
+			continue
+		}
+
+		port := &portInfo{
+			info:         info,
+			name:         info.Name(),
+			vendorId:     vendorId,
+			productId:    productId,
+			serialNumber: info.USBSerialNumber(),
+			product:      info.USBProduct(),
+		}
+
+		if port.product == "" {
+			port.product = info.Description()
+		}
+
+		device := strconv.Itoa(vendorId) + ":" + strconv.Itoa(productId) + ":" + port.serialNumber
+
+		if iface, ok := usbInterfaceNumber(port.name); ok {
+			port.iface = iface
+		} else {
+			port.iface = ordinals[device]
+		}
+
+		ordinals[device]++
+
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
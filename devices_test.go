@@ -0,0 +1,153 @@
+/*
+ * Whitecat Blocky Environment, device rule tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDeviceRuleMatches(t *testing.T) {
+	iface0, iface1 := 0, 1
+
+	cp210x := &portInfo{name: "/dev/ttyUSB0", vendorId: 0x10c4, productId: 0xea60, serialNumber: "0001A", product: "CP2102 USB to UART Bridge Controller", iface: 0}
+	ftdi1 := &portInfo{name: "/dev/ttyUSB2", vendorId: 0x403, productId: 0x6010, serialNumber: "FT123", product: "Dual RS232-HS", iface: 1}
+
+	tests := []struct {
+		name    string
+		rule    DeviceRule
+		port    *portInfo
+		matches bool
+	}{
+		{"empty rule", DeviceRule{}, cp210x, true},
+		{"vid pid", DeviceRule{VendorId: "0x10c4", ProductId: "0xea60"}, cp210x, true},
+		{"vid pid without 0x", DeviceRule{VendorId: "10C4", ProductId: "EA60"}, cp210x, true},
+		{"other pid", DeviceRule{VendorId: "0x10c4", ProductId: "0xea61"}, cp210x, false},
+		{"other vid", DeviceRule{VendorId: "0x403"}, cp210x, false},
+		{"invalid vid", DeviceRule{VendorId: "cp210x"}, cp210x, false},
+		{"interface", DeviceRule{VendorId: "0x403", Interface: &iface1}, ftdi1, true},
+		{"other interface", DeviceRule{VendorId: "0x403", Interface: &iface0}, ftdi1, false},
+		{"serial number wildcard", DeviceRule{SerialNumber: "0001*"}, cp210x, true},
+		{"other serial number", DeviceRule{SerialNumber: "0002*"}, cp210x, false},
+		{"product wildcard", DeviceRule{Product: "CP210?*"}, cp210x, true},
+		{"port wildcard", DeviceRule{Port: "/dev/ttyUSB*"}, ftdi1, true},
+		{"other port", DeviceRule{Port: "/dev/ttyACM*"}, ftdi1, false},
+		{"all conditions", DeviceRule{VendorId: "0x403", ProductId: "0x6010", SerialNumber: "FT*", Port: "/dev/ttyUSB2", Interface: &iface1}, ftdi1, true},
+	}
+
+	for _, test := range tests {
+		if matches := test.rule.matches(test.port); matches != test.matches {
+			t.Errorf("%s: matches is %v, expected %v", test.name, matches, test.matches)
+		}
+	}
+}
+
+func TestMatchDeviceRuleOrder(t *testing.T) {
+	port := &portInfo{name: "/dev/ttyUSB0", vendorId: 0x10c4, productId: 0xea60, iface: 0}
+
+	rules := []DeviceRule{
+		{VendorId: "0x403"},
+		{VendorId: "0x10c4", MaxBauds: 921600},
+		{VendorId: "0x10c4", ProductId: "0xea60", MaxBauds: 115200},
+	}
+
+	// First matching rule wins
+	if rule := matchDeviceRule(rules, port); rule == nil || rule.MaxBauds != 921600 {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+
+	// Excluded ports don't match, even if a later rule matches
+	rules = append([]DeviceRule{{Port: "/dev/ttyUSB0", Exclude: true}}, rules...)
+	if rule := matchDeviceRule(rules, port); rule != nil {
+		t.Errorf("excluded port matches %+v", rule)
+	}
+
+	if rule := matchDeviceRule(nil, port); rule != nil {
+		t.Errorf("port matches without rules %+v", rule)
+	}
+}
+
+func TestDefaultDeviceRules(t *testing.T) {
+	defer func(headless bool, rules []DeviceRule, ide []deviceDef) {
+		Headless = headless
+		AgentConfig.DeviceRules = rules
+		devices = ide
+	}(Headless, AgentConfig.DeviceRules, devices)
+
+	AgentConfig.DeviceRules = nil
+	devices = nil
+
+	ports := []struct {
+		port    *portInfo
+		matches bool
+	}{
+		{&portInfo{vendorId: 0x10c4, productId: 0xea60, iface: 0}, true},
+		{&portInfo{vendorId: 0x1a86, productId: 0x7523, iface: 0}, true},
+		{&portInfo{vendorId: 0x1a86, productId: 0x55d4, iface: 0}, true},
+		{&portInfo{vendorId: 0x403, productId: 0x6001, iface: 0}, true},
+		{&portInfo{vendorId: 0x403, productId: 0x6014, iface: 0}, true},
+		{&portInfo{vendorId: 0x403, productId: 0x6015, iface: 0}, true},
+		{&portInfo{vendorId: 0x403, productId: 0x6010, iface: 1}, true},
+
+		// The JTAG interface of the dual FTDI adapters is excluded
+		{&portInfo{vendorId: 0x403, productId: 0x6010, iface: 0}, false},
+
+		// Not a known USB-UART bridge
+		{&portInfo{vendorId: 0x2341, productId: 0x0043, iface: 0}, false},
+	}
+
+	Headless = true
+
+	for _, test := range ports {
+		if rule := matchDeviceRule(deviceRules(), test.port); (rule != nil) != test.matches {
+			t.Errorf("headless, port 0x%x:0x%x interface %d: matches is %v, expected %v", test.port.vendorId, test.port.productId, test.port.iface, rule != nil, test.matches)
+		}
+	}
+
+	// With the IDE only the requested devices match
+	Headless = false
+	devices = []deviceDef{{VendorId: "0x1a86", ProductId: "0x7523"}}
+
+	if matchDeviceRule(deviceRules(), ports[0].port) != nil {
+		t.Error("not requested device matches")
+	}
+
+	if matchDeviceRule(deviceRules(), ports[1].port) == nil {
+		t.Error("requested device doesn't match")
+	}
+
+	// User defined rules disable the default rules
+	Headless = true
+	devices = nil
+	AgentConfig.DeviceRules = []DeviceRule{{Port: "/dev/ttyUSB5"}}
+
+	if matchDeviceRule(deviceRules(), ports[0].port) != nil {
+		t.Error("default rules used with user defined rules")
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * Whitecat Blocky Environment, Lua evaluation
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Module with the evaluation helper, in the board
+const evalHelperFile = "/lib/lua/wcc-eval.lua"
+
+// Mark of the line with the evaluation result
+const evalMark = "<wcc-eval>"
+
+// Default timeout of an evaluation
+const evalTimeout = 10 * time.Second
+
+// Board side helper, that evaluates a chunk and prints the result as a JSON
+// object. The chunk is evaluated first as an expression, for get its value
+// as in the Lua REPL. The output of print and io.write is captured.
+const evalHelper = `-- Evaluation helper of the Whitecat agent
+local maxDepth = 8
+
+local function quote(s)
+	local special = {["\""] = "\\\"", ["\\"] = "\\\\", ["\n"] = "\\n", ["\r"] = "\\r", ["\t"] = "\\t"}
+
+	return "\"" .. (string.gsub(s, "[%c\"\\]", function(c)
+		return special[c] or string.format("\\u%04x", string.byte(c))
+	end)) .. "\""
+end
+
+local encode
+
+local function encodeTable(t, depth, seen)
+	if seen[t] then return quote("<cycle>") end
+	if depth > maxDepth then return quote(tostring(t)) end
+
+	seen[t] = true
+
+	local items = {}
+	local count = 0
+	for _ in pairs(t) do count = count + 1 end
+
+	if count > 0 and count == #t then
+		for i = 1, #t do
+			items[i] = encode(t[i], depth + 1, seen)
+		end
+
+		seen[t] = nil
+		return "[" .. table.concat(items, ",") .. "]"
+	end
+
+	for k, v in pairs(t) do
+		items[#items + 1] = quote(tostring(k)) .. ":" .. encode(v, depth + 1, seen)
+	end
+
+	seen[t] = nil
+	return "{" .. table.concat(items, ",") .. "}"
+end
+
+encode = function(v, depth, seen)
+	local t = type(v)
+
+	if t == "nil" then
+		return "null"
+	elseif t == "boolean" then
+		return tostring(v)
+	elseif t == "number" then
+		if v ~= v or v == math.huge or v == -math.huge then return quote(tostring(v)) end
+		if math.type and math.type(v) == "integer" then return string.format("%d", v) end
+		return string.format("%.14g", v)
+	elseif t == "string" then
+		return quote(v)
+	elseif t == "table" then
+		return encodeTable(v, depth, seen)
+	end
+
+	return quote(tostring(v))
+end
+
+return function(code)
+	local out = {}
+	local _print, _write = print, io.write
+
+	print = function(...)
+		local parts = {}
+		for i = 1, select("#", ...) do parts[i] = tostring((select(i, ...))) end
+		out[#out + 1] = table.concat(parts, "\t") .. "\n"
+	end
+
+	io.write = function(...)
+		for i = 1, select("#", ...) do out[#out + 1] = tostring((select(i, ...))) end
+		return io.stdout
+	end
+
+	local traceback
+	local f, err = load("return " .. code, "=eval")
+	if not f then f, err = load(code, "=eval") end
+
+	-- The code is sent in a global, free it
+	_wcc_eval_code = nil
+
+	local res
+	if f then
+		res = table.pack(xpcall(f, function(e)
+			traceback = debug.traceback(nil, 2)
+			return e
+		end))
+	else
+		res = {false, err, n = 2}
+	end
+
+	print, io.write = _print, _write
+
+	local items = {
+		"\"ok\":" .. tostring(res[1]),
+		"\"stdout\":" .. quote(table.concat(out))
+	}
+
+	if res[1] then
+		local values = {}
+		for i = 2, res.n do
+			local v = "{\"type\":" .. quote(type(res[i]))
+			if res[i] ~= nil then v = v .. ",\"value\":" .. encode(res[i], 1, {}) end
+			values[#values + 1] = v .. "}"
+		end
+		items[#items + 1] = "\"values\":[" .. table.concat(values, ",") .. "]"
+	else
+		items[#items + 1] = "\"error\":" .. quote(tostring(res[2]))
+		if traceback then items[#items + 1] = "\"traceback\":" .. quote(traceback) end
+	end
+
+	print("` + evalMark + `{" .. table.concat(items, ",") .. "}")
+end
+`
+
+// A value returned by an evaluation. Value is missing for nil.
+type EvalValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Result of an evaluation
+type EvalResult struct {
+	Ok        bool        `json:"ok"`
+	Values    []EvalValue `json:"values"`
+	Stdout    string      `json:"stdout"`
+	Error     string      `json:"error,omitempty"`
+	Traceback string      `json:"traceback,omitempty"`
+
+	// Evaluation has been interrupted by the timeout
+	Timeout bool `json:"timeout"`
+
+	// Board has been reset, because the evaluation doesn't stop
+	Reset bool `json:"reset"`
+
+	ElapsedMs int64 `json:"elapsedMs"`
+}
+
+// Upload the evaluation helper, if it is not in the board. The helper is
+// uploaded with the prerequisites, but they are not uploaded when the board
+// already has them, and then the helper can be missing if they were installed
+// by another tool, or by an older agent.
+func (board *Board) ensureEvalHelper() {
+	if board.evalHelper {
+		return
+	}
+
+	board.timeout(2000)
+	exists := board.sendCommand(luaWithAttributes(evalHelperFile, "print(att ~= nil and att.type == \"file\");"))
+	board.noTimeout()
+
+	if exists != "true" {
+		board.sendCommand(luaCall("os.mkdir", "/lib"))
+		board.sendCommand(luaCall("os.mkdir", "/lib/lua"))
+
+		if board.writeFile(evalHelperFile, []byte(evalHelper)) == "" {
+			panic(errors.New("can't upload the evaluation helper"))
+		}
+	}
+
+	board.evalHelper = true
+}
+
+// Collect the lines received while evaluating, until the prompt or the
+// deadline. The echo of the command is skipped. Returns false if the prompt
+// is not received.
+func (board *Board) evalOutput(result *EvalResult, command string, deadline time.Time) bool {
+	for {
+		line, ok := board.readLineUntil(deadline)
+		if !ok {
+			return false
+		}
+
+		if line == command {
+			continue
+		}
+
+		if isPrompt(line) {
+			return true
+		}
+
+		if strings.HasPrefix(line, evalMark) {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, evalMark)), result); err != nil {
+				result.Ok = false
+				result.Error = "invalid evaluation result: " + err.Error()
+			}
+		} else if line != "" {
+			// Output not captured by the helper, as the output of the C modules
+			result.Stdout += line + "\n"
+		}
+	}
+}
+
+// Evaluate a Lua chunk, and get its result. If the evaluation doesn't end
+// before the timeout it is interrupted, and if it doesn't stop the board is
+// reset.
+func (board *Board) evaluate(code []byte, timeout time.Duration) (result EvalResult) {
+	start := time.Now()
+
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			result.Ok = false
+			result.Error = fmt.Sprint(r)
+		}
+
+		result.ElapsedMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	}()
+
+	if timeout <= 0 {
+		timeout = evalTimeout
+	}
+
+	// Code can be an expression, or a chunk
+	if _, err := checkLua(append([]byte("return "), code...), nil); err != nil {
+		if err = board.checkLua("eval", code); err != nil {
+			return EvalResult{Error: err.Error()}
+		}
+	}
+
+	board.consoleOut = false
+	board.consoleIn = true
+
+	board.ensureEvalHelper()
+
+	// Send the code in chunks, it can be long for a command line
+	board.runCode([]byte("_wcc_eval_code = "+luaQuote(string(code))), nil)
+
+	board.consoleOut = false
+	board.consoleIn = true
+
+	board.port.Write([]byte("os.shell(false)\r\n"))
+	board.consume()
+
+	command := "require(\"wcc-eval\")(_wcc_eval_code)"
+	board.port.Write([]byte(command + "\r\n"))
+
+	if !board.evalOutput(&result, command, start.Add(timeout)) {
+		result.Ok = false
+		result.Timeout = true
+		result.Error = "timeout"
+
+		// Interrupt, and wait for the prompt
+		board.port.Write([]byte{0x03})
+
+		if !board.evalOutput(&result, command, time.Now().Add(runStopTimeout)) {
+			board.reset(false)
+			result.Reset = true
+			return result
+		}
+
+		result.Ok = false
+		result.Timeout = true
+	}
+
+	if board.shell {
+		board.port.Write([]byte("os.shell(true)\r\n"))
+		board.consume()
+	}
+
+	return result
+}
@@ -0,0 +1,355 @@
+/*
+ * Whitecat Blocky Environment, fake board, for the tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mikepb/go-serial"
+)
+
+// A board in memory. The commands written to its port are parsed with the Lua
+// lexer, and the string arguments of the function calls are recorded as the
+// board receives them. The board answers as Lua RTOS: the echo of the command,
+// the response, and the prompt.
+type fakeBoard struct {
+	t     *testing.T
+	board *Board
+
+	mutex   sync.Mutex
+	pending bytes.Buffer
+
+	// Output of the board, sent to the RX queue by its own goroutine, as the
+	// queue can be shorter than a response
+	out chan string
+
+	// Files and folders of the board, and their type
+	files map[string]string
+
+	// String arguments of each call, by function name
+	calls map[string][][]string
+}
+
+func newFakeBoard(t *testing.T) *fakeBoard {
+	fake := &fakeBoard{
+		t:     t,
+		files: map[string]string{"/": "directory"},
+		calls: make(map[string][][]string),
+		out:   make(chan string, 1024),
+	}
+
+	fake.board = &Board{
+		port:    fake,
+		dev:     "fake",
+		RXQueue: make(chan byte, 10*1024),
+		quit:    make(chan bool),
+	}
+
+	fake.board.noTimeout()
+
+	go func() {
+		for {
+			select {
+			case s := <-fake.out:
+				for i := 0; i < len(s); i++ {
+					select {
+					case fake.board.RXQueue <- s[i]:
+					case <-fake.board.quit:
+						return
+					}
+				}
+			case <-fake.board.quit:
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(fake.board.disconnected)
+
+	return fake
+}
+
+func (fake *fakeBoard) Read(b []byte) (int, error) {
+	<-fake.board.quit
+	return 0, errors.New("port closed")
+}
+
+func (fake *fakeBoard) Write(b []byte) (int, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.pending.Write(b)
+
+	// Commands end with \r, or \r\n
+	for {
+		line, err := fake.pending.ReadString('\r')
+		if err != nil {
+			fake.pending.WriteString(line)
+			break
+		}
+
+		line = strings.TrimPrefix(strings.TrimSuffix(line, "\r"), "\n")
+		if line != "" {
+			fake.run(line)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (fake *fakeBoard) Close() error                  { return nil }
+func (fake *fakeBoard) Apply(o *serial.Options) error { return nil }
+func (fake *fakeBoard) Sync() error                   { return nil }
+func (fake *fakeBoard) InputWaiting() (int, error)    { return 0, nil }
+
+func (fake *fakeBoard) send(s string) {
+	fake.out <- s
+}
+
+// Get the string arguments of the calls to a function
+func (fake *fakeBoard) callsTo(function string) [][]string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.calls[function]
+}
+
+// Get the string arguments of the last call to a function
+func (fake *fakeBoard) lastCall(function string) []string {
+	calls := fake.callsTo(function)
+	if len(calls) == 0 {
+		return nil
+	}
+
+	return calls[len(calls)-1]
+}
+
+// Record the function calls of a command, and answer it
+func (fake *fakeBoard) run(command string) {
+	fake.send(command + "\r\n")
+
+	tokens, err := lexLua([]byte(command))
+	if err != nil {
+		fake.t.Errorf("%s: %v", command, err)
+		fake.send("stdin:1: " + err.Error() + "\r\n/ > \r\n")
+		return
+	}
+
+	// Names used in the command, as os.remove, and the string arguments of
+	// the calls
+	names := make(map[string]bool)
+	called := make(map[string][][]string)
+
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].Type != luaName || (i > 0 && (tokens[i-1].Value == "." || tokens[i-1].Value == ":")) {
+			continue
+		}
+
+		name := tokens[i].Value
+		j := i + 1
+		for j+1 < len(tokens) && tokens[j].Value == "." && tokens[j+1].Type == luaName {
+			name = name + "." + tokens[j+1].Value
+			j += 2
+		}
+
+		names[name] = true
+
+		if j >= len(tokens) || tokens[j].Value != "(" {
+			continue
+		}
+
+		args := []string{}
+
+	arguments:
+		for depth := 0; j < len(tokens); j++ {
+			switch {
+			case tokens[j].Value == "(" || tokens[j].Value == "{":
+				depth++
+			case tokens[j].Value == ")" || tokens[j].Value == "}":
+				if depth--; depth == 0 {
+					break arguments
+				}
+			case tokens[j].Type == luaString && depth == 1:
+				arg, err := luaUnquote(tokens[j].Value)
+				if err != nil {
+					fake.t.Errorf("%s: %v", command, err)
+				}
+
+				args = append(args, arg)
+			}
+		}
+
+		fake.calls[name] = append(fake.calls[name], args)
+		called[name] = append(called[name], args)
+	}
+
+	fake.send(fake.response(names, called) + "/ > \r\n")
+}
+
+// Response to a command, as Lua RTOS prints it
+func (fake *fakeBoard) response(names map[string]bool, called map[string][][]string) string {
+	if calls := called["io.attributes"]; len(calls) == 1 && len(calls[0]) == 1 {
+		if kind, ok := fake.files[calls[0][0]]; ok {
+			return kind + "\t10\t0\r\n"
+		}
+
+		return "error: not found\r\n"
+	}
+
+	var args []string
+	if calls := called["pcall"]; len(calls) == 1 {
+		args = calls[0]
+	}
+
+	switch {
+	case names["os.ls"] && len(args) == 1:
+		if fake.files[args[0]] != "directory" {
+			return "error: " + args[0] + ": No such file or directory\r\n"
+		}
+
+		var entries []string
+		for file, kind := range fake.files {
+			if file != "/" && path.Dir(file) == path.Clean(args[0]) {
+				entries = append(entries, map[string]string{"file": "f", "directory": "d"}[kind]+"\t-\t-\t"+path.Base(file)+"\r\n")
+			}
+		}
+
+		sort.Strings(entries)
+
+		return strings.Join(entries, "") + "ok\r\n"
+
+	case names["os.mkdir"] && len(args) == 1:
+		fake.files[args[0]] = "directory"
+
+	case names["io.open"]:
+		for _, open := range called["io.open"] {
+			if len(open) == 2 && open[1] == "wb" {
+				fake.files[open[0]] = "file"
+			}
+		}
+	}
+
+	return "ok\r\n"
+}
+
+// Paths that must be quoted, sent as they are
+var fakeBoardPaths = []string{
+	"/a.lua",
+	"/with space.lua",
+	"/a \"quoted\" name.lua",
+	"/single 'quoted'.lua",
+	"/back\\slash.lua",
+	"/[[long]].lua",
+	"/new\nline.lua",
+	"/\xc3\xb1and\xfa.lua",
+	"/a.lua\"); os.remove(\"/autorun.lua",
+}
+
+func TestFakeBoardPaths(t *testing.T) {
+	for _, p := range fakeBoardPaths {
+		fake := newFakeBoard(t)
+
+		if err := fake.board.removeFile(p); err != nil {
+			t.Errorf("remove %q: %v", p, err)
+		}
+
+		if args := fake.lastCall("pcall"); !reflect.DeepEqual(args, []string{p}) {
+			t.Errorf("remove %q: board received %q", p, args)
+		}
+
+		if err := fake.board.rename(p, p+".bak"); err != nil {
+			t.Errorf("rename %q: %v", p, err)
+		}
+
+		if args := fake.lastCall("pcall"); !reflect.DeepEqual(args, []string{p, p + ".bak"}) {
+			t.Errorf("rename %q: board received %q", p, args)
+		}
+
+		if err := fake.board.mkdir(p); err != nil {
+			t.Errorf("mkdir %q: %v", p, err)
+		}
+
+		if stat, err := fake.board.stat(p); err != nil || stat.Type != "directory" || stat.Path != p {
+			t.Errorf("stat %q: %+v, %v", p, stat, err)
+		}
+
+		if args := fake.lastCall("io.attributes"); !reflect.DeepEqual(args, []string{p}) {
+			t.Errorf("stat %q: board received %q", p, args)
+		}
+
+		// Nothing else is run
+		if calls := fake.callsTo("os.remove"); len(calls) != 0 {
+			t.Errorf("%q: os.remove called %q", p, calls)
+		}
+	}
+}
+
+func TestFakeBoardCopyFolder(t *testing.T) {
+	fake := newFakeBoard(t)
+
+	fake.files["/src \"q\""] = "directory"
+	fake.files["/src \"q\"/it's.lua"] = "file"
+	fake.files["/src \"q\"/back\\slash"] = "directory"
+	fake.files["/src \"q\"/back\\slash/a b.lua"] = "file"
+
+	if err := fake.board.copy("/src \"q\"", "/dst \\ q"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files first, and then the folders
+	expected := [][]string{
+		{"/src \"q\"/it's.lua", "rb"},
+		{"/dst \\ q/it's.lua", "wb"},
+		{"/src \"q\"/back\\slash/a b.lua", "rb"},
+		{"/dst \\ q/back\\slash/a b.lua", "wb"},
+	}
+
+	if opened := fake.callsTo("io.open"); !reflect.DeepEqual(opened, expected) {
+		t.Errorf("board opened %q, expected %q", opened, expected)
+	}
+
+	for _, file := range []string{"/dst \\ q", "/dst \\ q/back\\slash", "/dst \\ q/back\\slash/a b.lua", "/dst \\ q/it's.lua"} {
+		if _, ok := fake.files[file]; !ok {
+			t.Errorf("%q not created", file)
+		}
+	}
+
+	// Errors of os.ls are reported
+	if _, _, err := fake.board.dirEntries("/missing"); err == nil {
+		t.Error("missing folder listed")
+	}
+}
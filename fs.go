@@ -0,0 +1,382 @@
+/*
+ * Whitecat Blocky Environment, filesystem operations
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Timeout of a filesystem operation, in milliseconds
+const fsTimeout = 2000
+
+// Timeout of a file copy, in milliseconds
+const fsCopyTimeout = 30000
+
+// Information of a file in the board
+type FsStat struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+}
+
+// Disk usage of a folder in the board. Used and Total are for the whole
+// filesystem, and are 0 if the firmware doesn't report them.
+type FsUsage struct {
+	Path        string `json:"path"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+	Size        int64  `json:"size"`
+	Used        int64  `json:"used"`
+	Total       int64  `json:"total"`
+}
+
+// Build the notification data of a filesystem operation. The result, if any,
+// is added with the name what.
+func fsNotification(where string, err error, what string, result interface{}) string {
+	data := jsonString("path") + ": " + jsonString(where) + ", " + jsonString("ok") + ": " + strconv.FormatBool(err == nil)
+
+	if err != nil {
+		data += ", " + jsonString("error") + ": " + jsonString(err.Error())
+	} else if result != nil {
+		b, _ := json.Marshal(result)
+		data += ", " + jsonString(what) + ": " + string(b)
+	}
+
+	return data
+}
+
+// Lua snippet that calls a function, and prints ok, or the error. Functions
+// can fail raising an error, or returning nil and the error.
+func fsCall(function string, args ...interface{}) string {
+	return "do local ok, r, e = " + luaCall("pcall", append([]interface{}{luaExpr(function)}, args...)...) + "; " +
+		"if not ok then e = r elseif r == false and e == nil then e = \"failed\" elseif r ~= nil then e = nil end; " +
+		"print(e == nil and \"ok\" or \"error: \" .. tostring(e)); end"
+}
+
+// Send a filesystem command to the board, and get the error printed by
+// the command, if any
+func (board *Board) fsCommand(command string, timeout int) (err error) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(timeout)
+
+	lines := strings.Split(strings.TrimSpace(board.sendCommand(command)), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+
+	switch {
+	case last == "ok":
+		return nil
+
+	case strings.HasPrefix(last, "error: "):
+		return errors.New(strings.TrimPrefix(last, "error: "))
+
+	case last == "":
+		return errors.New("no response")
+	}
+
+	return errors.New(last)
+}
+
+// Create a folder
+func (board *Board) mkdir(where string) error {
+	return board.fsCommand(fsCall("os.mkdir", where), fsTimeout)
+}
+
+// Rename, or move, a file or a folder
+func (board *Board) rename(from string, to string) error {
+	return board.fsCommand(fsCall("os.rename", from, to), fsTimeout)
+}
+
+// Get the information of a file, or a folder
+func (board *Board) stat(where string) (stat FsStat, err error) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(fsTimeout)
+
+	resp := board.sendCommand(luaWithAttributes(where, "if att == nil then print(\"error: not found\") else "+
+		"print(tostring(att.type) .. \"\\t\" .. tostring(att.size or 0) .. \"\\t\" .. tostring(att.modification or att.mtime or 0)) end;"))
+
+	lines := strings.Split(strings.TrimSpace(resp), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+
+	if strings.HasPrefix(last, "error: ") {
+		return stat, errors.New(where + ": " + strings.TrimPrefix(last, "error: "))
+	}
+
+	fields := strings.Split(last, "\t")
+	if len(fields) != 3 {
+		return stat, errors.New(where + ": unexpected response " + strconv.Quote(last))
+	}
+
+	stat.Path = where
+	stat.Type = fields[0]
+	stat.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+
+	// Times can be floats
+	if mtime, err := strconv.ParseFloat(fields[2], 64); err == nil {
+		stat.Mtime = int64(mtime)
+	}
+
+	return stat, nil
+}
+
+// Get the names of the files, and of the folders, of a folder
+func (board *Board) dirEntries(where string) (files []string, dirs []string, err error) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(fsTimeout)
+
+	// os.ls prints the entries, and then fsCall prints ok or the error
+	lines := strings.Split(strings.TrimSpace(board.sendCommand(fsCall("os.ls", where))), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+
+	switch {
+	case strings.HasPrefix(last, "error: "):
+		return nil, nil, errors.New(where + ": " + strings.TrimPrefix(last, "error: "))
+
+	case last != "ok":
+		return nil, nil, errors.New(where + ": unexpected response " + strconv.Quote(last))
+	}
+
+	for _, line := range lines[:len(lines)-1] {
+		element := strings.Split(strings.Replace(line, "\r", "", -1), "\t")
+
+		if len(element) == 4 {
+			if element[0] == "d" {
+				dirs = append(dirs, element[3])
+			} else {
+				files = append(files, element[3])
+			}
+		}
+	}
+
+	return files, dirs, nil
+}
+
+// Remove a file, or a folder and all its content
+func (board *Board) removeAll(where string) error {
+	stat, err := board.stat(where)
+	if err != nil {
+		return err
+	}
+
+	if stat.Type == "directory" {
+		files, dirs, err := board.dirEntries(where)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range append(files, dirs...) {
+			if err = board.removeAll(path.Join(where, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = board.removeFile(where); err != nil {
+		return errors.New(where + ": " + err.Error())
+	}
+
+	return nil
+}
+
+// Copy a file, or a folder and all its content. Files are copied by the
+// board, without transfer them.
+func (board *Board) copy(from string, to string) error {
+	// A file copied to itself is truncated
+	if path.Clean(to) == path.Clean(from) {
+		return errors.New("can't copy " + from + " to itself")
+	}
+
+	stat, err := board.stat(from)
+	if err != nil {
+		return err
+	}
+
+	if stat.Type != "directory" {
+		// Files are closed out of the pcall, so they are closed also on errors
+		err = board.fsCommand("do local src, dst; local ok, e = pcall(function() "+
+			"src = assert("+luaCall("io.open", from, "rb")+"); "+
+			"dst = assert("+luaCall("io.open", to, "wb")+"); "+
+			"while true do local data = src:read(512); if not data then break end; assert(dst:write(data)) end end); "+
+			"if src then src:close() end; if dst then dst:close() end; "+
+			"print(ok and \"ok\" or \"error: \" .. tostring(e)); end", fsCopyTimeout)
+		if err != nil {
+			return errors.New(from + ": " + err.Error())
+		}
+
+		return nil
+	}
+
+	if strings.HasPrefix(path.Clean(to), path.Clean(from)+"/") {
+		return errors.New("can't copy " + from + " into itself")
+	}
+
+	if err = board.mkdir(to); err != nil {
+		return errors.New(to + ": " + err.Error())
+	}
+
+	files, dirs, err := board.dirEntries(from)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(files, dirs...) {
+		if err = board.copy(path.Join(from, name), path.Join(to, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the disk usage of a file, or a folder
+func (board *Board) diskUsage(where string) (usage FsUsage, err error) {
+	var walk func(where string) error
+
+	walk = func(where string) error {
+		stat, err := board.stat(where)
+		if err != nil {
+			return err
+		}
+
+		if stat.Type != "directory" {
+			usage.Files++
+			usage.Size += stat.Size
+			return nil
+		}
+
+		usage.Directories++
+
+		files, dirs, err := board.dirEntries(where)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range append(files, dirs...) {
+			if err = walk(path.Join(where, name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	usage.Path = where
+
+	if err = walk(where); err != nil {
+		return usage, err
+	}
+
+	if usage.Used, usage.Total, err = board.fsStats(); err != nil {
+		return usage, err
+	}
+
+	return usage, nil
+}
+
+// Get the used and the total bytes of the filesystem. Both are 0 if the
+// firmware doesn't report them.
+func (board *Board) fsStats() (used int64, total int64, err error) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(fsTimeout)
+
+	resp := board.sendCommand("do local ok, fs = pcall(os.stats, \"fs\"); " +
+		"if ok and type(fs) == \"table\" and fs.used and fs.total then print(tostring(fs.used) .. \"\\t\" .. tostring(fs.total)) else print(\"unsupported\") end; end")
+
+	lines := strings.Split(strings.TrimSpace(resp), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+
+	if last == "unsupported" {
+		return 0, 0, nil
+	}
+
+	fields := strings.Split(last, "\t")
+	if len(fields) != 2 {
+		return 0, 0, errors.New("unexpected response " + strconv.Quote(last))
+	}
+
+	if used, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+
+	if total, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+
+	return used, total, nil
+}
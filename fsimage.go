@@ -0,0 +1,320 @@
+/*
+ * Whitecat Blocky Environment, filesystem images
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Lua RTOS filesystem defaults
+const fsBlockSize = 4096
+const fsPageSize = 256
+
+// Where the filesystem image must be flashed
+type fsLayout struct {
+	Type   string
+	Offset uint32
+	Size   uint32
+}
+
+// Get the filesystem layout from a firmware folder. The offset is the one used
+// in flashfs_args, and the size is the size of the partition at this offset.
+func firmwareFsLayout(folder string) (*fsLayout, error) {
+	b, err := ioutil.ReadFile(path.Join(folder, "flashfs_args"))
+	if err != nil {
+		return nil, err
+	}
+
+	var layout *fsLayout
+	var image string
+
+	args := regexp.MustCompile(`'.*?'|".*?"|\S+`).FindAllString(string(b), -1)
+
+	for i := 0; i+1 < len(args); i++ {
+		if offset, err := strconv.ParseUint(args[i], 0, 32); err == nil && strings.HasPrefix(args[i], "0x") {
+			layout = &fsLayout{Offset: uint32(offset)}
+			image = strings.Trim(args[i+1], "\"'")
+			break
+		}
+	}
+
+	if layout == nil {
+		return nil, errors.New("filesystem offset not found in firmware")
+	}
+
+	// Size
+	if partitions, err := firmwarePartitionTable(folder); err == nil {
+		for _, p := range partitions {
+			if p.Offset == layout.Offset {
+				layout.Size = p.Size
+
+				if p.SubType == "littlefs" {
+					layout.Type = "lfs"
+				}
+			}
+		}
+	}
+
+	if layout.Size == 0 {
+		// Use the size of the firmware's image
+		if finfo, err := os.Stat(path.Join(folder, image)); err == nil {
+			layout.Size = uint32(finfo.Size())
+		} else {
+			return nil, errors.New("filesystem size not found in firmware")
+		}
+	}
+
+	// Type
+	if AgentConfig.Filesystem.Type != "" {
+		layout.Type = AgentConfig.Filesystem.Type
+	} else if layout.Type == "" {
+		if strings.Contains(strings.ToLower(path.Base(image)), "lfs") && !strings.Contains(strings.ToLower(path.Base(image)), "spiffs") {
+			layout.Type = "lfs"
+		} else {
+			layout.Type = "spiffs"
+		}
+	}
+
+	return layout, nil
+}
+
+// Name of the tool that builds images of a filesystem type
+func fsToolName(fsType string) string {
+	name := "mkspiffs"
+	if fsType == "lfs" {
+		name = "mklittlefs"
+	}
+
+	return name
+}
+
+// Download the tool that builds images of a filesystem type
+func downloadFsTool(name string) error {
+	notify("boardUpdate", "Downloading "+name)
+
+	url := "http://downloads.whitecatboard.org/" + name + "/" + name + "-" + runtime.GOOS + ".zip"
+
+	log.Println("downloading " + name + " from " + url + " ...")
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("can't download " + name + ": " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	log.Println("downloaded")
+
+	err = ioutil.WriteFile(path.Join(AppDataTmpFolder, name+".zip"), body, 0777)
+	if err != nil {
+		return err
+	}
+
+	notify("boardUpdate", "Unpacking "+name)
+
+	log.Println("unpacking " + name + " ...")
+
+	unzip(path.Join(AppDataTmpFolder, name+".zip"), path.Join(AppDataTmpFolder, "utils"))
+
+	return nil
+}
+
+// Find the tool that builds images of a filesystem type. If the tool is not
+// in the utils folder, nor in the PATH, it is downloaded.
+func fsTool(fsType string) (string, error) {
+	if AgentConfig.Filesystem.Tool != "" {
+		return AgentConfig.Filesystem.Tool, nil
+	}
+
+	name := fsToolName(fsType)
+
+	exe := name
+	if runtime.GOOS == "windows" {
+		exe = exe + ".exe"
+	}
+
+	candidates := []string{path.Join(AppDataTmpFolder, "utils", exe), path.Join(AppDataTmpFolder, "utils", name, exe)}
+
+	find := func() string {
+		for _, tool := range candidates {
+			if _, err := os.Stat(tool); err == nil {
+				return tool
+			}
+		}
+
+		return ""
+	}
+
+	if tool := find(); tool != "" {
+		return tool, nil
+	}
+
+	if tool, err := exec.LookPath(exe); err == nil {
+		return tool, nil
+	}
+
+	if err := downloadFsTool(name); err != nil {
+		return "", err
+	}
+
+	if tool := find(); tool != "" {
+		return tool, nil
+	}
+
+	return "", errors.New(name + " not found")
+}
+
+// Build a filesystem image with the contents of a folder
+func buildFsImage(folder string, layout *fsLayout, image string) error {
+	blockSize := AgentConfig.Filesystem.BlockSize
+	if blockSize == 0 {
+		blockSize = fsBlockSize
+	}
+
+	pageSize := AgentConfig.Filesystem.PageSize
+	if pageSize == 0 {
+		pageSize = fsPageSize
+	}
+
+	if finfo, err := os.Stat(folder); err != nil {
+		return err
+	} else if !finfo.IsDir() {
+		return errors.New(folder + " is not a folder")
+	}
+
+	tool, err := fsTool(layout.Type)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+
+	switch layout.Type {
+	case "spiffs", "lfs":
+		// mkspiffs and mklittlefs share the same command line
+		args = []string{"-c", folder, "-b", strconv.Itoa(blockSize), "-p", strconv.Itoa(pageSize), "-s", strconv.Itoa(int(layout.Size)), image}
+	default:
+		return errors.New("unknown filesystem type " + layout.Type)
+	}
+
+	log.Println("executing: ", tool, strings.Join(args, " "))
+
+	out, err := exec.Command(tool, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s %s", path.Base(tool), err.Error(), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Get the filesystem layout from the partition table of the board, that is
+// the first data partition of a filesystem type
+func partitionsFsLayout(partitions []Partition) *fsLayout {
+	for _, p := range partitions {
+		if p.Type != "data" || (p.SubType != "spiffs" && p.SubType != "littlefs") {
+			continue
+		}
+
+		layout := &fsLayout{Type: "spiffs", Offset: p.Offset, Size: p.Size}
+
+		if AgentConfig.Filesystem.Type != "" {
+			layout.Type = AgentConfig.Filesystem.Type
+		} else if p.SubType == "littlefs" {
+			layout.Type = "lfs"
+		}
+
+		return layout
+	}
+
+	return nil
+}
+
+// Build a filesystem image with the contents of a folder, and flash it to the
+// board. The filesystem layout is taken from the partition table of the board,
+// and only if the board hasn't a filesystem partition, from the firmware. If
+// image is not empty, is the local folder of the firmware, if not the last
+// build of the board's firmware is used.
+func (board *Board) flashFilesystem(folder string, image string) error {
+	return board.withEsptool(func() error {
+		var layout *fsLayout
+
+		if partitions, err := board.readPartitionTable(); err == nil {
+			layout = partitionsFsLayout(partitions)
+		} else {
+			log.Println("can't read partition table: ", err)
+		}
+
+		if layout == nil {
+			if image == "" {
+				if err := downloadFirmware(board.firmware); err != nil {
+					return err
+				}
+
+				image = path.Join(AppDataTmpFolder, "firmware_files")
+			}
+
+			var err error
+
+			if layout, err = firmwareFsLayout(image); err != nil {
+				return err
+			}
+		}
+
+		notify("boardUpdate", "Building filesystem image")
+
+		image := path.Join(AppDataTmpFolder, "fs_image.img")
+		os.Remove(image)
+
+		if err := buildFsImage(folder, layout, image); err != nil {
+			return err
+		}
+
+		return board.esptool("--baud", partitionBauds, "write_flash", fmt.Sprintf("0x%x", layout.Offset), image)
+	})
+}
@@ -0,0 +1,155 @@
+//+build linux
+
+/*
+ * Whitecat Blocky Environment, serial port events, linux
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"log"
+	"strings"
+	"time"
+)
+
+// Netlink group of the events sent by udev, once the device node is created
+// and has its permissions set. Kernel events (group 1) can arrive before.
+const udevEventGroup = 2
+
+// Watch serial port events using the udev netlink socket. Events are sent to
+// the events channel until stop is closed.
+func watchPorts(events chan portEvent, stop chan bool) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: udevEventGroup})
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	// Don't block forever on read, so we can test for stop
+	timeout := unix.NsecToTimeval(int64(time.Second))
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buffer := make([]byte, 8192)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, _, err := unix.Recvfrom(fd, buffer, 0)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EINTR {
+					continue
+				}
+
+				log.Println("can't read port events:", err)
+				return
+			}
+
+			if event, ok := parseUevent(buffer[:n]); ok {
+				select {
+				case events <- event:
+				default:
+					// Channel is full, events are debounced anyway
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Parse an uevent, and get the tty add / remove events. udev messages start
+// with a header, that has the offset and the length of the properties.
+func parseUevent(msg []byte) (portEvent, bool) {
+	var event portEvent
+
+	subsystem := ""
+
+	if bytes.HasPrefix(msg, []byte("libudev\x00")) {
+		if len(msg) < 24 {
+			return event, false
+		}
+
+		// Header is in host byte order, little endian in the supported platforms
+		offset := int(binary.LittleEndian.Uint32(msg[16:20]))
+		length := int(binary.LittleEndian.Uint32(msg[20:24]))
+		if offset < 24 || offset+length > len(msg) {
+			return event, false
+		}
+
+		msg = msg[offset : offset+length]
+	}
+
+	for _, field := range strings.Split(string(msg), "\x00") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "ACTION":
+			event.action = parts[1]
+		case "SUBSYSTEM":
+			subsystem = parts[1]
+		case "DEVNAME":
+			event.dev = parts[1]
+		}
+	}
+
+	if subsystem != "tty" || event.dev == "" {
+		return event, false
+	}
+
+	if event.action != "add" && event.action != "remove" {
+		return event, false
+	}
+
+	if !strings.HasPrefix(event.dev, "/") {
+		event.dev = "/dev/" + event.dev
+	}
+
+	return event, true
+}
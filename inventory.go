@@ -0,0 +1,277 @@
+/*
+ * Whitecat Blocky Environment, board inventory
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A board known by the agent
+type InventoryEntry struct {
+	Key          string    `json:"key"`
+	SerialNumber string    `json:"serialNumber"`
+	Mac          string    `json:"mac"`
+	Model        string    `json:"model"`
+	Brand        string    `json:"brand"`
+	Subtype      string    `json:"subtype"`
+	Build        string    `json:"build"`
+	Commit       string    `json:"commit"`
+	Port         string    `json:"port"`
+	Chip         ChipInfo  `json:"chip"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Name         string    `json:"name"`
+	Notes        string    `json:"notes"`
+}
+
+// Persistent inventory of boards, stored in inventory.json in the user data
+// folder
+type inventoryDB struct {
+	mutex   sync.Mutex
+	loaded  bool
+	entries map[string]*InventoryEntry
+}
+
+var Inventory = &inventoryDB{}
+
+func inventoryFile() string {
+	return path.Join(AppDataFolder, "inventory.json")
+}
+
+// Load the inventory, if not loaded. Must be called with the mutex held.
+func (db *inventoryDB) load() {
+	if db.loaded {
+		return
+	}
+
+	db.loaded = true
+	db.entries = make(map[string]*InventoryEntry)
+
+	b, err := ioutil.ReadFile(inventoryFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("can't read inventory", err)
+		}
+
+		return
+	}
+
+	var entries []*InventoryEntry
+
+	if err = json.Unmarshal(b, &entries); err != nil {
+		log.Println("invalid inventory", err)
+		return
+	}
+
+	for _, entry := range entries {
+		db.entries[entry.Key] = entry
+	}
+}
+
+// Save the inventory. Must be called with the mutex held.
+func (db *inventoryDB) save() error {
+	b, err := json.MarshalIndent(db.sorted(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(inventoryFile(), b, 0644)
+}
+
+// Get the entries sorted by key. Must be called with the mutex held.
+func (db *inventoryDB) sorted() []InventoryEntry {
+	entries := []InventoryEntry{}
+
+	for _, entry := range db.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+func (db *inventoryDB) list() []InventoryEntry {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	return db.sorted()
+}
+
+func (db *inventoryDB) get(key string) (InventoryEntry, bool) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	entry, ok := db.entries[key]
+	if !ok {
+		return InventoryEntry{}, false
+	}
+
+	return *entry, true
+}
+
+// Set the user assigned name and notes of a board
+func (db *inventoryDB) update(key string, name string, notes string) (InventoryEntry, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	entry, ok := db.entries[key]
+	if !ok {
+		return InventoryEntry{}, errors.New("board " + key + " not found")
+	}
+
+	entry.Name = name
+	entry.Notes = notes
+
+	return *entry, db.save()
+}
+
+func (db *inventoryDB) remove(key string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	if _, ok := db.entries[key]; !ok {
+		return errors.New("board " + key + " not found")
+	}
+
+	delete(db.entries, key)
+
+	return db.save()
+}
+
+// Record that a board has been seen. Returns the board's key, or an empty
+// string if the board can't be identified.
+func (db *inventoryDB) seen(board *Board, boardInfo *BoardInfo) string {
+	key := board.identityKey()
+	if key == "" {
+		return ""
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	now := time.Now()
+
+	entry, ok := db.entries[key]
+	if !ok {
+		entry = &InventoryEntry{Key: key, FirstSeen: now}
+		db.entries[key] = entry
+	}
+
+	entry.SerialNumber = board.devInfo.USBSerialNumber()
+	entry.Model = board.model
+	entry.Brand = board.brand
+	entry.Subtype = board.subtype
+	entry.Build = boardInfo.Build
+	entry.Commit = boardInfo.Commit
+	entry.Port = board.dev
+	entry.LastSeen = now
+
+	// Chip information that the firmware don't know, is kept from the last time
+	// the board was flashed
+	chip := board.chip
+	chip.merge(entry.Chip)
+	entry.Chip = chip
+	entry.Mac = chip.Mac
+
+	if err := db.save(); err != nil {
+		log.Println("can't save inventory", err)
+	}
+
+	return key
+}
+
+// Record the chip information got from the ROM bootloader when the board is
+// flashed
+func (db *inventoryDB) flashed(board *Board, chip ChipInfo) {
+	chip.merge(board.chip)
+	board.chip = chip
+
+	key := board.identityKey()
+	if key == "" {
+		return
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.load()
+
+	entry, ok := db.entries[key]
+	if !ok {
+		entry = &InventoryEntry{Key: key, FirstSeen: time.Now()}
+		db.entries[key] = entry
+	}
+
+	chip.merge(entry.Chip)
+	entry.Chip = chip
+	entry.Mac = chip.Mac
+	entry.SerialNumber = board.devInfo.USBSerialNumber()
+	entry.Port = board.dev
+
+	if err := db.save(); err != nil {
+		log.Println("can't save inventory", err)
+	}
+}
+
+// Get the key that identifies the board in the inventory. The MAC belongs to
+// the chip, the USB serial number belongs to the USB-UART adapter, and many
+// adapters share the same serial number, or have none.
+func (board *Board) identityKey() string {
+	if board.chip.Mac != "" {
+		return "mac:" + board.chip.Mac
+	}
+
+	if serialNumber := board.devInfo.USBSerialNumber(); serialNumber != "" {
+		return "usb:" + serialNumber
+	}
+
+	return ""
+}
@@ -0,0 +1,741 @@
+/*
+ * Whitecat Blocky Environment, Lua static checks
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Globals of the Lua standard library, and of the Lua RTOS base
+var luaStandardGlobals = map[string]bool{
+	"_G": true, "_ENV": true, "_VERSION": true, "arg": true, "assert": true,
+	"bit32": true, "collectgarbage": true, "coroutine": true, "debug": true,
+	"dofile": true, "error": true, "getmetatable": true, "io": true,
+	"ipairs": true, "load": true, "loadfile": true, "loadstring": true,
+	"math": true, "module": true, "next": true, "os": true, "package": true,
+	"pairs": true, "pcall": true, "print": true, "rawequal": true,
+	"rawget": true, "rawlen": true, "rawset": true, "require": true,
+	"select": true, "setmetatable": true, "string": true, "table": true,
+	"tonumber": true, "tostring": true, "type": true, "unpack": true,
+	"utf8": true, "xpcall": true,
+}
+
+// A warning about a Lua source, that doesn't prevent to run it
+type luaWarning struct {
+	Line    int    `json:"line"`
+	Col     int    `json:"col"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// A recursive descent parser for Lua 5.3, used only for check the syntax
+// and collect the globals used by a source
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+
+	// Local variables, one map for each block
+	scopes []map[string]bool
+
+	// Functions being parsed, true if vararg
+	functions []bool
+
+	// Loops being parsed, in the current function
+	loops []int
+
+	// Globals assigned and referenced
+	assigned   map[string]bool
+	referenced []luaToken
+}
+
+func (p *luaParser) token() luaToken {
+	return p.tokens[p.pos]
+}
+
+func (p *luaParser) next() luaToken {
+	token := p.tokens[p.pos]
+	if token.Type != luaEOF {
+		p.pos++
+	}
+
+	return token
+}
+
+// Test if the current token is the keyword or operator what
+func (p *luaParser) is(what string) bool {
+	token := p.token()
+
+	return (token.Type == luaKeyword || token.Type == luaOp) && token.Value == what
+}
+
+func (p *luaParser) accept(what string) bool {
+	if p.is(what) {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func near(token luaToken) string {
+	if token.Type == luaEOF {
+		return "near <eof>"
+	}
+
+	return "near '" + token.Value + "'"
+}
+
+// Stop parsing with a syntax error at the current token
+func (p *luaParser) fail(message string) {
+	token := p.token()
+
+	panic(&luaSyntaxError{Line: token.Line, Col: token.Col, Message: message + " " + near(token)})
+}
+
+func (p *luaParser) expect(what string) {
+	if !p.accept(what) {
+		p.fail("'" + what + "' expected")
+	}
+}
+
+// Expect the token that closes a construction started in line
+func (p *luaParser) expectClose(what string, who string, line int) {
+	if p.accept(what) {
+		return
+	}
+
+	if p.token().Line == line {
+		p.expect(what)
+	}
+
+	p.fail(fmt.Sprintf("'%s' expected (to close '%s' at line %d)", what, who, line))
+}
+
+func (p *luaParser) name() luaToken {
+	token := p.token()
+	if token.Type != luaName {
+		p.fail("<name> expected")
+	}
+
+	return p.next()
+}
+
+func (p *luaParser) openScope() {
+	p.scopes = append(p.scopes, make(map[string]bool))
+}
+
+func (p *luaParser) closeScope() {
+	p.scopes = p.scopes[:len(p.scopes)-1]
+}
+
+func (p *luaParser) declare(name string) {
+	p.scopes[len(p.scopes)-1][name] = true
+}
+
+func (p *luaParser) isLocal(name string) bool {
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		if p.scopes[i][name] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A name used as a variable
+func (p *luaParser) variable(token luaToken, assigned bool) {
+	if p.isLocal(token.Value) {
+		return
+	}
+
+	if assigned {
+		p.assigned[token.Value] = true
+	} else {
+		p.referenced = append(p.referenced, token)
+	}
+}
+
+func blockFollow(token luaToken) bool {
+	if token.Type == luaEOF {
+		return true
+	}
+
+	if token.Type != luaKeyword {
+		return false
+	}
+
+	switch token.Value {
+	case "else", "elseif", "end", "until":
+		return true
+	}
+
+	return false
+}
+
+func (p *luaParser) block() {
+	p.openScope()
+	p.statements()
+	p.closeScope()
+}
+
+// Parse the statements of a block, in the current scope
+func (p *luaParser) statements() {
+	for !blockFollow(p.token()) {
+		if p.is("return") {
+			p.next()
+			if !blockFollow(p.token()) && !p.is(";") {
+				p.expressionList()
+			}
+			p.accept(";")
+
+			if !blockFollow(p.token()) {
+				p.fail("'<eof>' expected")
+			}
+
+			return
+		}
+
+		p.statement()
+	}
+}
+
+func (p *luaParser) statement() {
+	token := p.token()
+	line := token.Line
+
+	switch {
+	case p.accept(";"):
+
+	case p.accept("::"):
+		p.name()
+		p.expect("::")
+
+	case p.accept("break"):
+		if p.loops[len(p.loops)-1] == 0 {
+			panic(&luaSyntaxError{Line: token.Line, Col: token.Col, Message: "break outside a loop"})
+		}
+
+	case p.accept("goto"):
+		p.name()
+
+	case p.accept("do"):
+		p.block()
+		p.expectClose("end", "do", line)
+
+	case p.accept("while"):
+		p.expression()
+		p.expect("do")
+		p.loopBlock()
+		p.expectClose("end", "while", line)
+
+	case p.accept("repeat"):
+		// The condition can use the locals of the block
+		p.openScope()
+		p.loops[len(p.loops)-1]++
+		p.statements()
+		p.loops[len(p.loops)-1]--
+		p.expectClose("until", "repeat", line)
+		p.expression()
+		p.closeScope()
+
+	case p.accept("if"):
+		p.expression()
+		p.expect("then")
+		p.block()
+
+		for p.accept("elseif") {
+			p.expression()
+			p.expect("then")
+			p.block()
+		}
+
+		if p.accept("else") {
+			p.block()
+		}
+
+		p.expectClose("end", "if", line)
+
+	case p.accept("for"):
+		p.forStatement(line)
+
+	case p.accept("function"):
+		// funcname: Name {'.' Name} [':' Name]
+		name := p.name()
+		p.variable(name, !p.is(".") && !p.is(":"))
+
+		method := false
+		for p.is(".") || p.is(":") {
+			method = p.next().Value == ":"
+			p.name()
+			if method {
+				break
+			}
+		}
+
+		p.functionBody(method, line)
+
+	case p.accept("local"):
+		if p.accept("function") {
+			// The function can call itself
+			p.declare(p.name().Value)
+			p.functionBody(false, line)
+			break
+		}
+
+		var names []string
+		for {
+			names = append(names, p.name().Value)
+			if !p.accept(",") {
+				break
+			}
+		}
+
+		if p.accept("=") {
+			p.expressionList()
+		}
+
+		for _, name := range names {
+			p.declare(name)
+		}
+
+	default:
+		p.expressionStatement()
+	}
+}
+
+func (p *luaParser) loopBlock() {
+	p.loops[len(p.loops)-1]++
+	p.block()
+	p.loops[len(p.loops)-1]--
+}
+
+func (p *luaParser) forStatement(line int) {
+	var names []string
+
+	names = append(names, p.name().Value)
+
+	if p.accept("=") {
+		p.expression()
+		p.expect(",")
+		p.expression()
+		if p.accept(",") {
+			p.expression()
+		}
+	} else {
+		for p.accept(",") {
+			names = append(names, p.name().Value)
+		}
+
+		p.expect("in")
+		p.expressionList()
+	}
+
+	p.expect("do")
+
+	p.openScope()
+	for _, name := range names {
+		p.declare(name)
+	}
+	p.loopBlock()
+	p.closeScope()
+
+	p.expectClose("end", "for", line)
+}
+
+// An assignment, or a function call
+func (p *luaParser) expressionStatement() {
+	start := p.pos
+
+	assignable, call := p.suffixedExpression(false)
+
+	if !p.is("=") && !p.is(",") {
+		if !call {
+			p.fail("syntax error")
+		}
+
+		return
+	}
+
+	targets := []int{start}
+
+	for {
+		if !assignable {
+			p.fail("syntax error")
+		}
+
+		if !p.accept(",") {
+			break
+		}
+
+		targets = append(targets, p.pos)
+		assignable, _ = p.suffixedExpression(false)
+	}
+
+	p.expect("=")
+	p.expressionList()
+
+	// Bare names assigned are globals, if not locals
+	for _, target := range targets {
+		token := p.tokens[target]
+		if next := p.tokens[target+1]; token.Type == luaName && next.Type == luaOp && (next.Value == "=" || next.Value == ",") {
+			p.variable(token, true)
+		}
+	}
+}
+
+// Parse primaryexp { '.' Name | '[' exp ']' | ':' Name args | args }, and
+// get if the expression can be assigned, and if it's a function call
+func (p *luaParser) suffixedExpression(reference bool) (assignable bool, call bool) {
+	token := p.token()
+
+	switch {
+	case token.Type == luaName:
+		p.next()
+
+		// Names assigned are registered after parse the assignment
+		if reference || !(p.is("=") || p.is(",")) {
+			p.variable(token, false)
+		}
+
+		assignable = true
+
+	case p.accept("("):
+		p.expression()
+		p.expectClose(")", "(", token.Line)
+
+	default:
+		p.fail("unexpected symbol")
+	}
+
+	for {
+		switch {
+		case p.accept("."):
+			p.name()
+			assignable, call = true, false
+
+		case p.accept("["):
+			p.expression()
+			p.expect("]")
+			assignable, call = true, false
+
+		case p.accept(":"):
+			p.name()
+			p.arguments()
+			assignable, call = false, true
+
+		case p.is("(") || p.is("{") || p.token().Type == luaString:
+			p.arguments()
+			assignable, call = false, true
+
+		default:
+			return
+		}
+	}
+}
+
+func (p *luaParser) arguments() {
+	token := p.token()
+
+	switch {
+	case token.Type == luaString:
+		p.next()
+
+	case p.is("{"):
+		p.table()
+
+	case p.accept("("):
+		if !p.is(")") {
+			p.expressionList()
+		}
+		p.expectClose(")", "(", token.Line)
+
+	default:
+		p.fail("function arguments expected")
+	}
+}
+
+func (p *luaParser) table() {
+	line := p.token().Line
+
+	p.expect("{")
+
+	for !p.is("}") {
+		if p.accept("[") {
+			p.expression()
+			p.expect("]")
+			p.expect("=")
+		} else if p.token().Type == luaName && p.tokens[p.pos+1].Type == luaOp && p.tokens[p.pos+1].Value == "=" {
+			p.next()
+			p.next()
+		}
+
+		p.expression()
+
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+
+	p.expectClose("}", "{", line)
+}
+
+func (p *luaParser) functionBody(method bool, line int) {
+	vararg := false
+
+	p.openScope()
+	if method {
+		p.declare("self")
+	}
+
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				vararg = true
+				break
+			}
+
+			p.declare(p.name().Value)
+
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+
+	p.functions = append(p.functions, vararg)
+	p.loops = append(p.loops, 0)
+
+	p.block()
+
+	p.functions = p.functions[:len(p.functions)-1]
+	p.loops = p.loops[:len(p.loops)-1]
+
+	p.closeScope()
+
+	p.expectClose("end", "function", line)
+}
+
+func (p *luaParser) expressionList() {
+	p.expression()
+	for p.accept(",") {
+		p.expression()
+	}
+}
+
+var luaBinaryOps = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "//": true, "%": true,
+	"^": true, "..": true, "==": true, "~=": true, "<": true, "<=": true,
+	">": true, ">=": true, "and": true, "or": true, "&": true, "|": true,
+	"~": true, "<<": true, ">>": true,
+}
+
+func (p *luaParser) expression() {
+	for {
+		// Unary operators
+		for p.is("not") || p.is("-") || p.is("#") || p.is("~") {
+			p.next()
+		}
+
+		p.simpleExpression()
+
+		token := p.token()
+		if (token.Type != luaOp && token.Type != luaKeyword) || !luaBinaryOps[token.Value] {
+			return
+		}
+
+		p.next()
+	}
+}
+
+func (p *luaParser) simpleExpression() {
+	token := p.token()
+
+	switch {
+	case token.Type == luaNumber || token.Type == luaString:
+		p.next()
+
+	case p.accept("nil") || p.accept("true") || p.accept("false"):
+
+	case p.is("..."):
+		if !p.functions[len(p.functions)-1] {
+			p.fail("cannot use '...' outside a vararg function")
+		}
+		p.next()
+
+	case p.is("{"):
+		p.table()
+
+	case p.accept("function"):
+		p.functionBody(false, token.Line)
+
+	default:
+		p.suffixedExpression(true)
+	}
+}
+
+// Check the syntax of a Lua source, and get the globals used that are not
+// assigned in the source, nor are in known
+func checkLua(src []byte, known map[string]bool) (warnings []luaWarning, err error) {
+	tokens, err := lexLua(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// The parser doesn't need the comments
+	p := &luaParser{assigned: make(map[string]bool)}
+	for _, token := range tokens {
+		if token.Type != luaComment {
+			p.tokens = append(p.tokens, token)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if syntaxErr, ok := r.(*luaSyntaxError); ok {
+				warnings, err = nil, syntaxErr
+				return
+			}
+
+			panic(r)
+		}
+	}()
+
+	// The main chunk is a vararg function
+	p.functions = []bool{true}
+	p.loops = []int{0}
+
+	p.block()
+	if p.token().Type != luaEOF {
+		p.fail("'<eof>' expected")
+	}
+
+	if known == nil {
+		return nil, nil
+	}
+
+	for _, token := range p.referenced {
+		if known[token.Value] || luaStandardGlobals[token.Value] || p.assigned[token.Value] {
+			continue
+		}
+
+		warnings = append(warnings, luaWarning{
+			Line:    token.Line,
+			Col:     token.Col,
+			Name:    token.Value,
+			Message: "unknown global '" + token.Value + "'",
+		})
+	}
+
+	return warnings, nil
+}
+
+// Get the Lua modules of the firmware, from the board info. Returns nil if
+// the modules are unknown.
+func (board *Board) luaModules() map[string]bool {
+	var info struct {
+		Modules json.RawMessage `json:"modules"`
+	}
+
+	if err := json.Unmarshal([]byte(board.info), &info); err != nil || info.Modules == nil {
+		return nil
+	}
+
+	modules := make(map[string]bool)
+
+	// Modules can be a list of names, a list of objects with the name, or an
+	// object with the names as keys
+	var list []interface{}
+	var object map[string]interface{}
+
+	if json.Unmarshal(info.Modules, &list) == nil {
+		for _, module := range list {
+			switch module := module.(type) {
+			case string:
+				modules[module] = true
+
+			case map[string]interface{}:
+				for _, key := range []string{"name", "id"} {
+					if name, ok := module[key].(string); ok {
+						modules[name] = true
+					}
+				}
+			}
+		}
+	} else if json.Unmarshal(info.Modules, &object) == nil {
+		for name := range object {
+			modules[name] = true
+		}
+	}
+
+	return modules
+}
+
+// Check a Lua source before send it to the board. Syntax errors are notified
+// and returned. Unknown globals are notified as warnings, if enabled in the
+// config. If the check is disabled in the config, the errors are reported by
+// the board.
+func (board *Board) checkLua(where string, src []byte) error {
+	var known map[string]bool
+
+	if AgentConfig.Check.Disable {
+		return nil
+	}
+
+	if AgentConfig.Check.Globals {
+		known = board.luaModules()
+	}
+
+	warnings, err := checkLua(src, known)
+	if err != nil {
+		info := jsonString("path") + ": " + jsonString(where)
+
+		if syntaxErr, ok := err.(*luaSyntaxError); ok {
+			info += ", " + jsonString("line") + ": " + fmt.Sprint(syntaxErr.Line) +
+				", " + jsonString("col") + ": " + fmt.Sprint(syntaxErr.Col) +
+				", " + jsonString("message") + ": " + jsonString(syntaxErr.Message)
+		} else {
+			info += ", " + jsonString("message") + ": " + jsonString(err.Error())
+		}
+
+		notify("boardSyntaxError", "{"+info+"}")
+
+		return fmt.Errorf("%s:%v", where, err)
+	}
+
+	if len(warnings) > 0 {
+		list, _ := json.Marshal(warnings)
+		notify("boardLuaWarnings", "{"+jsonString("path")+": "+jsonString(where)+", "+jsonString("warnings")+": "+string(list)+"}")
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Whitecat Blocky Environment, Lua syntax check tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// Get the files of a folder of the Lua corpus
+func luaCorpus(t *testing.T, folder string) map[string][]byte {
+	files, err := filepath.Glob(filepath.Join("testdata", "luacheck", folder, "*.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		t.Fatal("no files in the " + folder + " corpus")
+	}
+
+	corpus := make(map[string][]byte)
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		corpus[filepath.Base(file)] = src
+	}
+
+	return corpus
+}
+
+func TestCheckLuaValid(t *testing.T) {
+	for name, src := range luaCorpus(t, "valid") {
+		if _, err := checkLua(src, nil); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+// Each file of the invalid corpus starts with the expected error position, as
+// "-- error: line:col"
+var luaErrorHeaderRe = regexp.MustCompile(`^-- error: (\d+):(\d+)`)
+
+func TestCheckLuaInvalid(t *testing.T) {
+	for name, src := range luaCorpus(t, "invalid") {
+		header := luaErrorHeaderRe.FindSubmatch(src)
+		if header == nil {
+			t.Errorf("%s: error position header missing", name)
+			continue
+		}
+
+		line, _ := strconv.Atoi(string(header[1]))
+		col, _ := strconv.Atoi(string(header[2]))
+
+		_, err := checkLua(src, nil)
+		if err == nil {
+			t.Errorf("%s: error expected", name)
+			continue
+		}
+
+		syntaxErr, ok := err.(*luaSyntaxError)
+		if !ok {
+			t.Errorf("%s: unexpected error type %T", name, err)
+			continue
+		}
+
+		if syntaxErr.Line != line || syntaxErr.Col != col {
+			t.Errorf("%s: error at %d:%d, expected %d:%d (%v)", name, syntaxErr.Line, syntaxErr.Col, line, col, err)
+		}
+	}
+}
+
+func TestCheckLuaGlobals(t *testing.T) {
+	src := []byte("local t = {x = 1, f\"=\"}\ny = t.x\nprint(z, y, string.len(\"=\"))\n")
+
+	warnings, err := checkLua(src, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) != 2 || warnings[0].Name != "f" || warnings[1].Name != "z" {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+}
+
+func TestCheckLuaDisabled(t *testing.T) {
+	defer func(disable bool) {
+		AgentConfig.Check.Disable = disable
+	}(AgentConfig.Check.Disable)
+
+	board := &Board{}
+
+	AgentConfig.Check.Disable = true
+
+	if err := board.checkLua("test.lua", []byte("local function")); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Whitecat Blocky Environment, Lua command builder
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A Lua expression, that is used as is when building a command
+type luaExpr string
+
+// Quote a string as a Lua string literal. Control and non-ASCII bytes are
+// escaped, so the literal can be sent in one line, and the board echoes it
+// as sent.
+func luaQuote(s string) string {
+	var quoted strings.Builder
+
+	quoted.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+
+		case c < 0x20 || c >= 0x7f:
+			// Use always 3 digits, a digit can follow
+			quoted.WriteString("\\")
+			quoted.WriteString(strconv.Itoa(int(c) + 1000)[1:])
+
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+
+	quoted.WriteByte('"')
+
+	return quoted.String()
+}
+
+// Build the arguments of a Lua call. Strings are quoted, and luaExpr are
+// used as is.
+func luaArgs(args ...interface{}) string {
+	var list []string
+
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			list = append(list, luaQuote(arg))
+
+		case luaExpr:
+			list = append(list, string(arg))
+
+		case int:
+			list = append(list, strconv.Itoa(arg))
+
+		case int64:
+			list = append(list, strconv.FormatInt(arg, 10))
+
+		case bool:
+			list = append(list, strconv.FormatBool(arg))
+
+		case nil:
+			list = append(list, "nil")
+
+		default:
+			panic("unsupported Lua argument")
+		}
+	}
+
+	return strings.Join(list, ", ")
+}
+
+// Build a call to a Lua function
+func luaCall(function string, args ...interface{}) string {
+	return function + "(" + luaArgs(args...) + ")"
+}
+
+// Build a block that gets the attributes of a file in att, and runs body
+func luaWithAttributes(path string, body string) string {
+	return "do local att = " + luaCall("io.attributes", path) + "; " + body + " end"
+}
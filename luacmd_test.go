@@ -0,0 +1,299 @@
+/*
+ * Whitecat Blocky Environment, Lua command builder tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Decode a Lua short string literal, as the Lua lexer does
+func luaUnquote(literal string) (string, error) {
+	if len(literal) < 2 || literal[0] != literal[len(literal)-1] || (literal[0] != '"' && literal[0] != '\'') {
+		return "", errors.New("not a string literal")
+	}
+
+	quote := literal[0]
+	s := literal[1 : len(literal)-1]
+
+	var decoded bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c == quote || c == '\n' || c == '\r' {
+			return "", errors.New("unescaped " + strconv.QuoteRune(rune(c)))
+		}
+
+		if c != '\\' {
+			decoded.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", errors.New("unfinished escape")
+		}
+
+		switch c = s[i]; c {
+		case 'a':
+			decoded.WriteByte('\a')
+		case 'b':
+			decoded.WriteByte('\b')
+		case 'f':
+			decoded.WriteByte('\f')
+		case 'n':
+			decoded.WriteByte('\n')
+		case 'r':
+			decoded.WriteByte('\r')
+		case 't':
+			decoded.WriteByte('\t')
+		case 'v':
+			decoded.WriteByte('\v')
+		case '\\', '"', '\'', '\n':
+			decoded.WriteByte(c)
+
+		case 'x':
+			if i+2 >= len(s) {
+				return "", errors.New("unfinished \\x escape")
+			}
+
+			value, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", err
+			}
+
+			decoded.WriteByte(byte(value))
+			i += 2
+
+		default:
+			if c < '0' || c > '9' {
+				return "", errors.New("invalid escape \\" + string(c))
+			}
+
+			// Up to 3 digits, as many as there are
+			end := i
+			for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '9' {
+				end++
+			}
+
+			value, _ := strconv.Atoi(s[i:end])
+			if value > 255 {
+				return "", errors.New("decimal escape too large")
+			}
+
+			decoded.WriteByte(byte(value))
+			i = end - 1
+		}
+	}
+
+	return decoded.String(), nil
+}
+
+func checkLuaQuote(t *testing.T, s string) {
+	quoted := luaQuote(s)
+
+	// One line, and only printable ASCII, so the board echoes it as sent
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] < 0x20 || quoted[i] >= 0x7f {
+			t.Fatalf("luaQuote(%q) = %q, has byte 0x%02x", s, quoted, quoted[i])
+		}
+	}
+
+	decoded, err := luaUnquote(quoted)
+	if err != nil {
+		t.Fatalf("luaQuote(%q) = %q: %v", s, quoted, err)
+	}
+
+	if decoded != s {
+		t.Fatalf("luaQuote(%q) = %q, decoded as %q", s, quoted, decoded)
+	}
+}
+
+func TestLuaQuote(t *testing.T) {
+	tests := []string{
+		"",
+		"/autorun.lua",
+		"/a \"quoted\" name.lua",
+		"back\\slash",
+		"\\\"",
+		"\x00\x01\x1f\x7f",
+		"\xc3\xb1and\xfa.lua",
+		"\xff\xfe",
+		"\r\n\t",
+		"\\n",
+	}
+
+	for _, s := range tests {
+		checkLuaQuote(t, s)
+	}
+}
+
+// A digit after a decimal escape must not be part of the escape
+func TestLuaQuoteDigitAfterEscape(t *testing.T) {
+	for _, s := range []string{"\x012", "\x0012", "\n1", "\x7f99", "\xff0", "\x01\x02\x033"} {
+		checkLuaQuote(t, s)
+	}
+}
+
+func TestLuaCall(t *testing.T) {
+	tests := []struct {
+		call     string
+		expected string
+	}{
+		{luaCall("os.remove", "/a.lua"), `os.remove("/a.lua")`},
+		{luaCall("io.open", "/a\"b.lua", "rb"), `io.open("/a\"b.lua", "rb")`},
+		{luaCall("f", luaExpr("x"), 1, int64(2), true, nil), `f(x, 1, 2, true, nil)`},
+		{luaCall("f"), `f()`},
+	}
+
+	for _, test := range tests {
+		if test.call != test.expected {
+			t.Errorf("got %s, expected %s", test.call, test.expected)
+		}
+	}
+}
+
+func FuzzLuaQuote(f *testing.F) {
+	for _, seed := range []string{"", "/a.lua", "\"", "\\", "\x00", "\x012", "\n", "\x7f", "\x80", "\xff9", "a\\\"b"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		checkLuaQuote(t, s)
+
+		// The call must be valid Lua, and the argument must be the string
+		call := luaCall("os.remove", s)
+
+		if _, err := checkLua([]byte(call), nil); err != nil {
+			t.Fatalf("%s: %v", call, err)
+		}
+
+		tokens, err := lexLua([]byte(call))
+		if err != nil {
+			t.Fatalf("%s: %v", call, err)
+		}
+
+		if len(tokens) < 6 || tokens[4].Type != luaString {
+			t.Fatalf("%s: unexpected tokens %v", call, tokens)
+		}
+
+		if decoded, err := luaUnquote(tokens[4].Value); err != nil || decoded != s {
+			t.Fatalf("%s: argument decoded as %q, %v", call, decoded, err)
+		}
+
+		// And the board must receive the path as is, over the serial port
+		fake := newFakeBoard(t)
+
+		if err := fake.board.removeFile(s); err != nil {
+			t.Fatalf("remove %q: %v", s, err)
+		}
+
+		if calls := fake.callsTo("pcall"); len(calls) != 1 || len(calls[0]) != 1 || calls[0][0] != s {
+			t.Fatalf("remove %q: board received %q", s, calls)
+		}
+	})
+}
+
+// Send a notification, and get the message
+func notifyMessage(t *testing.T, notification string, data string) map[string]interface{} {
+	var out bytes.Buffer
+
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	notify(notification, data)
+
+	line := out.String()
+
+	i := strings.Index(line, "{")
+	if i < 0 {
+		t.Fatalf("%s: no message in %q", notification, line)
+	}
+
+	var msg map[string]interface{}
+
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line[i:])), &msg); err != nil {
+		t.Fatalf("%s: invalid JSON %q: %v", notification, line[i:], err)
+	}
+
+	return msg
+}
+
+// The notifications with hand-built JSON strings must get base64 data, so
+// board paths are never sent as is
+func TestNotifyBoardPaths(t *testing.T) {
+	path := "/a \"b\" \\c\n\x01\xff.lua"
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(path))
+
+	for notification, field := range map[string]string{
+		"boardReadFile":   "content",
+		"boardConsoleOut": "content",
+		"boardRunCommand": "response",
+	} {
+		msg := notifyMessage(t, notification, encoded)
+
+		info, _ := msg["info"].(map[string]interface{})
+		if info[field] != encoded {
+			t.Errorf("%s: unexpected info %v", notification, msg["info"])
+		}
+	}
+
+	msg := notifyMessage(t, "boardUpdate", "Uploading "+path)
+
+	info, _ := msg["info"].(map[string]interface{})
+	what, err := base64.StdEncoding.DecodeString(info["what"].(string))
+	if err != nil || string(what) != "Uploading "+path {
+		t.Errorf("boardUpdate: unexpected info %v", msg["info"])
+	}
+
+	msg = notifyMessage(t, "attachIde", "")
+
+	info, _ = msg["info"].(map[string]interface{})
+	if info["agent-version"] != Version {
+		t.Errorf("attachIde: unexpected info %v", msg["info"])
+	}
+
+	// Filesystem notifications quote the paths
+	msg = notifyMessage(t, "boardStat", fsNotification(path, errors.New(path), "", nil))
+
+	info, _ = msg["info"].(map[string]interface{})
+	if info["path"] != strings.ToValidUTF8(path, "\ufffd") {
+		t.Errorf("boardStat: unexpected info %v", msg["info"])
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Whitecat Blocky Environment, Lua runtime error enrichment
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of source lines sent before and after the line of a runtime error
+const luaErrorContextLines = 3
+
+// Time to wait for the traceback of a runtime error before sending the
+// notification
+const luaErrorIdleTimeout = 200 * time.Millisecond
+
+// Max number of traceback lines
+const luaErrorMaxTraceback = 50
+
+var (
+	luaTracebackStartRe = regexp.MustCompile(`^\s*stack traceback:\s*$`)
+	luaTracebackLineRe  = regexp.MustCompile(`^\s+(.*)$`)
+	luaTracebackFrameRe = regexp.MustCompile(`^([^:]*):(\d*):?\s*(.*)$`)
+)
+
+// A frame of a Lua traceback
+type LuaTracebackFrame struct {
+	Where string `json:"where"`
+	Line  string `json:"line"`
+	What  string `json:"what"`
+}
+
+// A source line, base64 encoded
+type LuaSourceLine struct {
+	Line int    `json:"line"`
+	Code string `json:"code"`
+}
+
+// Sources of the files sent to the board, by path
+type sourceCache struct {
+	mutex   sync.Mutex
+	sources map[string][]byte
+
+	// Source maps of the files whose line numbers have changed when sent
+	maps map[string][]int
+}
+
+func normalizeSourcePath(where string) string {
+	return path.Clean("/" + where)
+}
+
+func (cache *sourceCache) set(where string, source []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.sources == nil {
+		cache.sources = make(map[string][]byte)
+	}
+
+	cache.sources[normalizeSourcePath(where)] = source
+	delete(cache.maps, normalizeSourcePath(where))
+}
+
+func (cache *sourceCache) setMap(where string, sourceMap []int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.maps == nil {
+		cache.maps = make(map[string][]int)
+	}
+
+	if sourceMap == nil {
+		delete(cache.maps, normalizeSourcePath(where))
+	} else {
+		cache.maps[normalizeSourcePath(where)] = sourceMap
+	}
+}
+
+func (cache *sourceCache) getMap(where string) []int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.maps[normalizeSourcePath(where)]
+}
+
+// Get the line of the original source for a line of the file sent to the
+// board
+func (cache *sourceCache) originalLine(where string, line int) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	sourceMap, ok := cache.maps[normalizeSourcePath(where)]
+	if !ok || line < 1 || line > len(sourceMap) {
+		return line
+	}
+
+	return sourceMap[line-1]
+}
+
+// Get the source lines around a line
+func (cache *sourceCache) context(where string, line int) []LuaSourceLine {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	source, ok := cache.sources[normalizeSourcePath(where)]
+	if !ok || line < 1 {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(strings.Replace(string(source), "\r", "", -1), "\n"), "\n")
+	if line > len(lines) {
+		return nil
+	}
+
+	first := line - luaErrorContextLines
+	if first < 1 {
+		first = 1
+	}
+
+	last := line + luaErrorContextLines
+	if last > len(lines) {
+		last = len(lines)
+	}
+
+	context := []LuaSourceLine{}
+	for i := first; i <= last; i++ {
+		context = append(context, LuaSourceLine{
+			Line: i,
+			Code: base64.StdEncoding.EncodeToString([]byte(lines[i-1])),
+		})
+	}
+
+	return context
+}
+
+// Collects the traceback of a Lua runtime error, and keeps the blocks that are
+// active when the error is raised
+type luaErrorCollector struct {
+	mutex sync.Mutex
+
+	sources *sourceCache
+
+	// Active blocks, innermost last
+	blocks []string
+
+	// Pending error, waiting for the traceback
+	pending   *InspectorEvent
+	traceback []string
+	inside    bool
+	errBlocks []string
+	timer     *time.Timer
+}
+
+func (collector *luaErrorCollector) blockStart(block string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.blocks = append(collector.blocks, block)
+}
+
+func (collector *luaErrorCollector) blockEnd(block string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	for i := len(collector.blocks) - 1; i >= 0; i-- {
+		if collector.blocks[i] == block {
+			collector.blocks = collector.blocks[:i]
+			break
+		}
+	}
+}
+
+func (collector *luaErrorCollector) clearBlocks() {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.blocks = nil
+}
+
+// Start collecting a runtime error. A previous pending error is sent.
+func (collector *luaErrorCollector) start(event *InspectorEvent) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if collector.pending != nil {
+		collector.flush()
+	}
+
+	collector.pending = event
+	collector.traceback = nil
+	collector.inside = false
+	collector.errBlocks = append([]string{}, collector.blocks...)
+	collector.timer = time.AfterFunc(luaErrorIdleTimeout, collector.expire)
+}
+
+// Feed a line received from the board into the collector. Returns true if the
+// line is part of the traceback of the pending error.
+func (collector *luaErrorCollector) feed(line string) bool {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if collector.pending == nil {
+		return false
+	}
+
+	if !collector.inside {
+		if luaTracebackStartRe.MatchString(line) {
+			collector.inside = true
+			collector.timer.Reset(luaErrorIdleTimeout)
+			return true
+		}
+	} else if parts := luaTracebackLineRe.FindStringSubmatch(line); parts != nil {
+		if len(collector.traceback) < luaErrorMaxTraceback {
+			collector.traceback = append(collector.traceback, parts[1])
+		}
+
+		collector.timer.Reset(luaErrorIdleTimeout)
+		return true
+	}
+
+	collector.flush()
+
+	return false
+}
+
+func (collector *luaErrorCollector) expire() {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if collector.pending != nil {
+		collector.flush()
+	}
+}
+
+// Enrich the pending error and notify the IDE. Must be called with the mutex
+// held.
+func (collector *luaErrorCollector) flush() {
+	collector.timer.Stop()
+
+	event := collector.pending
+	info := event.Info
+
+	// Line in the original source
+	line, _ := strconv.Atoi(event.Fields["line"])
+	if original := collector.sources.originalLine(event.Fields["where"], line); original != line {
+		info = strings.Replace(info, jsonString("line")+": "+jsonString(event.Fields["line"]), jsonString("line")+": "+jsonString(strconv.Itoa(original)), 1)
+		line = original
+	}
+
+	// Source context
+	if context := collector.sources.context(event.Fields["where"], line); context != nil {
+		b, _ := json.Marshal(context)
+		info = info + ", \"context\": " + string(b)
+	}
+
+	// Traceback
+	frames := []LuaTracebackFrame{}
+	for _, line := range collector.traceback {
+		if parts := luaTracebackFrameRe.FindStringSubmatch(line); parts != nil {
+			frameLine := parts[2]
+			if n, err := strconv.Atoi(frameLine); err == nil {
+				frameLine = strconv.Itoa(collector.sources.originalLine(parts[1], n))
+			}
+
+			frames = append(frames, LuaTracebackFrame{Where: parts[1], Line: frameLine, What: parts[3]})
+		} else {
+			frames = append(frames, LuaTracebackFrame{What: line})
+		}
+	}
+
+	b, _ := json.Marshal(frames)
+	info = info + ", \"traceback\": " + string(b)
+
+	// Active blocks, innermost first
+	if len(collector.errBlocks) > 0 {
+		blocks := []string{}
+		for i := len(collector.errBlocks) - 1; i >= 0; i-- {
+			blocks = append(blocks, base64.StdEncoding.EncodeToString([]byte(collector.errBlocks[i])))
+		}
+
+		b, _ := json.Marshal(blocks)
+		info = info + ", \"block\": " + jsonString(blocks[0]) + ", \"blocks\": " + string(b)
+	}
+
+	collector.pending = nil
+	collector.traceback = nil
+	collector.errBlocks = nil
+
+	notify(event.Notification, info)
+}
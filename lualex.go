@@ -0,0 +1,336 @@
+/*
+ * Whitecat Blocky Environment, Lua lexer
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type luaTokenType int
+
+const (
+	luaEOF luaTokenType = iota
+	luaName
+	luaKeyword
+	luaNumber
+	luaString
+	luaOp
+	luaComment
+)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// Operators, longest first
+var luaOps = []string{
+	"...", "..", "==", "~=", "<=", ">=", "<<", ">>", "//", "::",
+	"+", "-", "*", "/", "%", "^", "#", "&", "~", "|", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// A Lua token. Value is the source text of the token.
+type luaToken struct {
+	Type  luaTokenType
+	Value string
+	Line  int
+	Col   int
+}
+
+// A syntax error in a Lua source
+type luaSyntaxError struct {
+	Line    int
+	Col     int
+	Message string
+}
+
+func (err *luaSyntaxError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", err.Line, err.Col, err.Message)
+}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func isLuaDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLuaHexDigit(c byte) bool {
+	return isLuaDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isLuaNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isLuaNameChar(c byte) bool {
+	return isLuaNameStart(c) || isLuaDigit(c)
+}
+
+func (lex *luaLexer) peek(offset int) byte {
+	if lex.pos+offset < len(lex.src) {
+		return lex.src[lex.pos+offset]
+	}
+
+	return 0
+}
+
+// Advance n bytes, counting lines
+func (lex *luaLexer) advance(n int) {
+	for i := 0; i < n && lex.pos < len(lex.src); i++ {
+		c := lex.src[lex.pos]
+		lex.pos++
+
+		if c == '\n' || (c == '\r' && lex.peek(0) != '\n') {
+			lex.line++
+			lex.col = 1
+		} else {
+			lex.col++
+		}
+	}
+}
+
+func (lex *luaLexer) fail(line int, col int, message string) error {
+	return &luaSyntaxError{Line: line, Col: col, Message: message}
+}
+
+// Get the level of the long bracket at the current position, or -1 if there
+// is not a long bracket
+func (lex *luaLexer) longBracket() int {
+	if lex.peek(0) != '[' {
+		return -1
+	}
+
+	level := 0
+	for lex.peek(1+level) == '=' {
+		level++
+	}
+
+	if lex.peek(1+level) != '[' {
+		return -1
+	}
+
+	return level
+}
+
+// Read a long string or comment, starting at the opening long bracket
+func (lex *luaLexer) readLong(level int, what string) error {
+	line, col := lex.line, lex.col
+	closing := "]" + strings.Repeat("=", level) + "]"
+
+	end := strings.Index(lex.src[lex.pos+level+2:], closing)
+	if end < 0 {
+		return lex.fail(line, col, "unfinished long "+what)
+	}
+
+	lex.advance(level + 2 + end + len(closing))
+
+	return nil
+}
+
+func (lex *luaLexer) readString() error {
+	line, col := lex.line, lex.col
+	quote := lex.peek(0)
+
+	lex.advance(1)
+
+	for {
+		c := lex.peek(0)
+
+		switch {
+		case lex.pos >= len(lex.src), c == '\n', c == '\r':
+			return lex.fail(line, col, "unfinished string")
+		case c == quote:
+			lex.advance(1)
+			return nil
+		case c == '\\':
+			lex.advance(1)
+
+			if lex.pos >= len(lex.src) {
+				return lex.fail(line, col, "unfinished string")
+			}
+
+			if lex.peek(0) == 'z' {
+				// Skip the following white space
+				lex.advance(1)
+				for lex.pos < len(lex.src) && strings.IndexByte(" \t\r\n\f\v", lex.peek(0)) >= 0 {
+					lex.advance(1)
+				}
+			} else if lex.peek(0) == '\r' && lex.peek(1) == '\n' {
+				lex.advance(2)
+			} else {
+				lex.advance(1)
+			}
+		default:
+			lex.advance(1)
+		}
+	}
+}
+
+// Valid decimal and hexadecimal numbers
+var luaNumberRe = regexp.MustCompile(`^(?:(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][+-]?[0-9]+)?|0[xX](?:[0-9a-fA-F]+\.?[0-9a-fA-F]*|\.[0-9a-fA-F]+)(?:[pP][+-]?[0-9]+)?)$`)
+
+func (lex *luaLexer) readNumber() error {
+	start, line, col := lex.pos, lex.line, lex.col
+
+	digit := isLuaDigit
+	exponent := "eE"
+
+	if lex.peek(0) == '0' && (lex.peek(1) == 'x' || lex.peek(1) == 'X') {
+		lex.advance(2)
+		digit = isLuaHexDigit
+		exponent = "pP"
+	}
+
+	for {
+		c := lex.peek(0)
+
+		if c != 0 && strings.IndexByte(exponent, c) >= 0 {
+			lex.advance(1)
+			if lex.peek(0) == '+' || lex.peek(0) == '-' {
+				lex.advance(1)
+			}
+		} else if digit(c) || c == '.' {
+			lex.advance(1)
+		} else {
+			break
+		}
+	}
+
+	if isLuaNameChar(lex.peek(0)) {
+		return lex.fail(line, col, "malformed number near '"+lex.src[start:lex.pos+1]+"'")
+	}
+
+	if !luaNumberRe.MatchString(lex.src[start:lex.pos]) {
+		return lex.fail(line, col, "malformed number near '"+lex.src[start:lex.pos]+"'")
+	}
+
+	return nil
+}
+
+// Split a Lua source into tokens. Comments are included.
+func lexLua(src []byte) ([]luaToken, error) {
+	lex := &luaLexer{src: string(src), line: 1, col: 1}
+
+	var tokens []luaToken
+
+	// Skip the first line, if it starts with #
+	if strings.HasPrefix(lex.src, "#") {
+		for lex.pos < len(lex.src) && lex.peek(0) != '\n' && lex.peek(0) != '\r' {
+			lex.advance(1)
+		}
+
+		tokens = append(tokens, luaToken{Type: luaComment, Value: lex.src[:lex.pos], Line: 1, Col: 1})
+	}
+
+	for {
+		// Skip white space
+		for lex.pos < len(lex.src) && strings.IndexByte(" \t\r\n\f\v", lex.peek(0)) >= 0 {
+			lex.advance(1)
+		}
+
+		if lex.pos >= len(lex.src) {
+			tokens = append(tokens, luaToken{Type: luaEOF, Line: lex.line, Col: lex.col})
+			return tokens, nil
+		}
+
+		start, line, col := lex.pos, lex.line, lex.col
+		c := lex.peek(0)
+
+		var tokenType luaTokenType
+		var err error
+
+		switch {
+		case c == '-' && lex.peek(1) == '-':
+			tokenType = luaComment
+			lex.advance(2)
+
+			if level := lex.longBracket(); level >= 0 {
+				err = lex.readLong(level, "comment")
+			} else {
+				for lex.pos < len(lex.src) && lex.peek(0) != '\n' && lex.peek(0) != '\r' {
+					lex.advance(1)
+				}
+			}
+
+		case c == '[' && lex.longBracket() >= 0:
+			tokenType = luaString
+			err = lex.readLong(lex.longBracket(), "string")
+
+		case c == '"' || c == '\'':
+			tokenType = luaString
+			err = lex.readString()
+
+		case isLuaDigit(c) || (c == '.' && isLuaDigit(lex.peek(1))):
+			tokenType = luaNumber
+			err = lex.readNumber()
+
+		case isLuaNameStart(c):
+			for isLuaNameChar(lex.peek(0)) {
+				lex.advance(1)
+			}
+
+			tokenType = luaName
+			if luaKeywords[lex.src[start:lex.pos]] {
+				tokenType = luaKeyword
+			}
+
+		default:
+			tokenType = luaOp
+
+			for _, op := range luaOps {
+				if strings.HasPrefix(lex.src[lex.pos:], op) {
+					lex.advance(len(op))
+					break
+				}
+			}
+
+			if lex.pos == start {
+				return tokens, lex.fail(line, col, fmt.Sprintf("unexpected symbol near '%c'", c))
+			}
+		}
+
+		if err != nil {
+			return tokens, err
+		}
+
+		tokens = append(tokens, luaToken{Type: tokenType, Value: lex.src[start:lex.pos], Line: line, Col: col})
+	}
+}
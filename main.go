@@ -56,6 +56,7 @@ var SupportedBoardsURL = "https://raw.githubusercontent.com/whitecatboard/Lua-RT
 
 func usage() {
 	fmt.Println("wccagent: usage: wccagent [-b | -lf | -lc | -ui | -v | -p folder]")
+	fmt.Println("       wccagent command [arguments]")
 	fmt.Println("")
 	fmt.Println(" -b : run in background (only windows)")
 	fmt.Println(" -lf: log to file")
@@ -63,6 +64,8 @@ func usage() {
 	fmt.Println(" -ui: enable the user interface")
 	fmt.Println(" -v : show version")
 	fmt.Println(" -p : prerequissites folder")
+	fmt.Println("")
+	cliUsage()
 }
 
 func restart() {
@@ -90,6 +93,27 @@ func start(ui bool, background bool) {
 	}
 }
 
+// Get home directory, create the user data folder, and needed folders
+func setupAppDataFolder() {
+	usr, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	if runtime.GOOS == "darwin" {
+		AppDataFolder = path.Join(usr.HomeDir, ".wccagent")
+	} else if runtime.GOOS == "windows" {
+		AppDataFolder = path.Join(usr.HomeDir, "AppData", "The Whitecat Create Agent")
+	} else if runtime.GOOS == "linux" {
+		AppDataFolder = path.Join(usr.HomeDir, ".whitecat-create-agent")
+	}
+
+	AppDataTmpFolder = path.Join(AppDataFolder, "tmp")
+
+	_ = os.Mkdir(AppDataFolder, 0755)
+	_ = os.Mkdir(AppDataTmpFolder, 0755)
+}
+
 func main() {
 	includeInRespawn := false
 	withLogFile := false
@@ -101,6 +125,14 @@ func main() {
 	ok := true
 	i := 0
 
+	// Commands run without the user interface, and exit
+	if len(os.Args) > 1 && isCliCommand(os.Args[1]) {
+		log.SetOutput(ioutil.Discard)
+		setupAppDataFolder()
+		loadConfig()
+		os.Exit(runCli(os.Args[1], os.Args[2:]))
+	}
+
 	// Get arguments and process arguments
 	for _, arg := range os.Args {
 		includeInRespawn = true
@@ -148,24 +180,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Get home directory, create the user data folder, and needed folders
-	usr, err := user.Current()
-	if err != nil {
-		panic(err)
-	}
-
-	if runtime.GOOS == "darwin" {
-		AppDataFolder = path.Join(usr.HomeDir, ".wccagent")
-	} else if runtime.GOOS == "windows" {
-		AppDataFolder = path.Join(usr.HomeDir, "AppData", "The Whitecat Create Agent")
-	} else if runtime.GOOS == "linux" {
-		AppDataFolder = path.Join(usr.HomeDir, ".whitecat-create-agent")
-	}
-
-	AppDataTmpFolder = path.Join(AppDataFolder, "tmp")
-
-	_ = os.Mkdir(AppDataFolder, 0755)
-	_ = os.Mkdir(AppDataTmpFolder, 0755)
+	setupAppDataFolder()
 
 	// Get where program is executed
 	execFolder, err := osext.ExecutableFolder()
@@ -189,5 +204,7 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	loadConfig()
+
 	start(withUI, withBackground)
 }
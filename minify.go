@@ -0,0 +1,198 @@
+/*
+ * Whitecat Blocky Environment, Lua upload pipeline
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Test if two tokens can be written together, without a space between them
+func luaTokensJoin(prev luaToken, next luaToken) bool {
+	tokens, err := lexLua([]byte(prev.Value + next.Value))
+
+	return err == nil && len(tokens) == 3 && tokens[0].Value == prev.Value && tokens[1].Value == next.Value
+}
+
+// Minify a Lua source. Comments, indentation and blank lines are removed, and
+// the tokens of each line are separated by a space only if needed. Returns the
+// minified source, and the source map: the line of the original source for
+// each line of the minified source.
+func minifyLua(src []byte) ([]byte, []int, error) {
+	tokens, err := lexLua(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out bytes.Buffer
+	var sourceMap []int
+	var prev *luaToken
+
+	// Line of the original source where the last token ends
+	prevEnd := 0
+
+	for i := range tokens {
+		token := tokens[i]
+
+		if token.Type == luaComment || token.Type == luaEOF {
+			continue
+		}
+
+		if prev == nil || token.Line != prevEnd {
+			if prev != nil {
+				out.WriteString("\n")
+			}
+
+			sourceMap = append(sourceMap, token.Line)
+		} else if !luaTokensJoin(*prev, token) {
+			out.WriteString(" ")
+		}
+
+		out.WriteString(token.Value)
+
+		// Tokens with new lines, such as long strings
+		newLines := strings.Count(strings.Replace(token.Value, "\r\n", "\n", -1), "\n")
+		for line := 1; line <= newLines; line++ {
+			sourceMap = append(sourceMap, token.Line+line)
+		}
+
+		prev = &tokens[i]
+		prevEnd = token.Line + newLines
+	}
+
+	out.WriteString("\n")
+
+	return out.Bytes(), sourceMap, nil
+}
+
+// Find a luac built for Lua RTOS
+func findLuac() (string, error) {
+	if AgentConfig.Upload.Luac != "" {
+		return AgentConfig.Upload.Luac, nil
+	}
+
+	name := "luac"
+	if runtime.GOOS == "windows" {
+		name = name + ".exe"
+	}
+
+	luac := path.Join(AppDataTmpFolder, "utils", name)
+	if _, err := os.Stat(luac); err != nil {
+		return "", errors.New("luac not found")
+	}
+
+	return luac, nil
+}
+
+// Precompile a Lua source. The chunk name is the path of the file in the
+// board, so runtime errors show the same file name that the source.
+func precompileLua(where string, src []byte) ([]byte, error) {
+	luac, err := findLuac()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(AppDataTmpFolder, "luac")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	name := strings.TrimPrefix(path.Clean("/"+where), "/")
+
+	if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(filepath.FromSlash(name))), 0755); err != nil {
+		return nil, err
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), src, 0644); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(luac, "-o", "out.luac", name)
+	cmd.Dir = dir
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, errors.New(strings.TrimSpace(string(out)))
+	}
+
+	return ioutil.ReadFile(filepath.Join(dir, "out.luac"))
+}
+
+// Prepare a Lua source for upload, as set in the config. Returns the code to
+// upload, and the source map if the line numbers change.
+func prepareLua(where string, src []byte) ([]byte, []int) {
+	if AgentConfig.Upload.Precompile {
+		code, err := precompileLua(where, src)
+		if err == nil {
+			return code, nil
+		}
+
+		log.Println("can't precompile", where, err)
+	}
+
+	if AgentConfig.Upload.Minify {
+		code, sourceMap, err := minifyLua(src)
+		if err == nil {
+			return code, sourceMap
+		}
+
+		log.Println("can't minify", where, err)
+	}
+
+	return src, nil
+}
+
+// Write a file to the board. Lua sources are prepared as set in the config.
+func (board *Board) uploadFile(path string, buffer []byte) string {
+	if !strings.HasSuffix(path, ".lua") {
+		return board.writeFile(path, buffer)
+	}
+
+	code, sourceMap := prepareLua(path, buffer)
+
+	resp := board.writeFile(path, code)
+
+	// Keep the original source, for show the context of errors
+	if resp != "" {
+		board.sources.set(path, buffer)
+		board.sources.setMap(path, sourceMap)
+	}
+
+	return resp
+}
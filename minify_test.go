@@ -0,0 +1,97 @@
+/*
+ * Whitecat Blocky Environment, Lua minifier tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMinifyLua(t *testing.T) {
+	src, err := ioutil.ReadFile(filepath.Join("testdata", "minify", "sample.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "minify", "sample.min.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, sourceMap, err := minifyLua(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != string(expected) {
+		t.Errorf("unexpected minified source\n%s\nexpected\n%s", out, expected)
+	}
+
+	expectedMap := []int{6, 8, 9, 10, 11, 12, 13, 15, 16, 17, 19, 20, 21, 23, 24, 25}
+	if !reflect.DeepEqual(sourceMap, expectedMap) {
+		t.Errorf("source map is %v, expected %v", sourceMap, expectedMap)
+	}
+
+	// Each token of the minified source must be in the original source, at the
+	// line given by the source map
+	srcTokens, _ := lexLua(src)
+	outTokens, err := lexLua(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []luaToken
+	for _, token := range srcTokens {
+		if token.Type != luaComment {
+			tokens = append(tokens, token)
+		}
+	}
+
+	if len(tokens) != len(outTokens) {
+		t.Fatalf("%d tokens in the minified source, expected %d", len(outTokens), len(tokens))
+	}
+
+	for i, token := range outTokens {
+		if token.Type == luaEOF {
+			continue
+		}
+
+		if token.Value != tokens[i].Value {
+			t.Errorf("token %q at %d:%d, expected %q", token.Value, token.Line, token.Col, tokens[i].Value)
+			continue
+		}
+
+		if token.Line > len(sourceMap) || sourceMap[token.Line-1] != tokens[i].Line {
+			t.Errorf("token %q at minified line %d is mapped to the wrong line, expected %d", token.Value, token.Line, tokens[i].Line)
+		}
+	}
+}
@@ -32,140 +32,219 @@ package main
 import "C"
 
 import (
+	"fmt"
 	"github.com/mikepb/go-serial"
 	"log"
-	"strconv"
 	"time"
 )
 
 // Connected board
 var connectedBoard *Board = nil
 
-// This variable computes the elapsed time monitoring serial ports without success
-var elapsed int = 0
+// Time without port events before scanning the serial ports, for debounce
+// attach / detach events
+const monitorDebounce = 250 * time.Millisecond
 
-func tryLater() {
-	time.Sleep(time.Millisecond * 10)
+// Serial ports scan interval when no board is connected. If port events are
+// not available in the platform ports are polled at a shorter interval.
+const monitorScanInterval = 2 * time.Second
+const monitorPollInterval = 250 * time.Millisecond
 
-	if connectedBoard == nil {
-		elapsed = elapsed + 10
-		if elapsed > 5000 {
-			// No board found in the last 5 seconds
-			notify("boardUpdate", "No board attached")
+// Interval for test that the connected board is still connected
+const monitorCheckInterval = 500 * time.Millisecond
 
-			elapsed = 0
-		}
-	}
+// Time without a board before notify the IDE
+const monitorNoBoardInterval = 5 * time.Second
+
+// A serial port attach / detach event
+type portEvent struct {
+	// add / remove
+	action string
+
+	// Device name, for example /dev/ttyUSB0
+	dev string
 }
 
 // Monitor serial ports and search for a Lua RTOS device.
 // If a Lua RTOS device is found monitor the serial port.
 func monitor() {
-	defer func() {
-		log.Println("stop monitor ...")
-
-		if err := recover(); err != nil {
-			time.Sleep(time.Millisecond * 1000)
-			go monitor()
-		}
-	}()
-
 	log.Println("start monitor ...")
+	defer log.Println("stop monitor ...")
 
 	// Notify IDE that monitor is searching for a board
 	notify("boardUpdate", "Scanning boards")
 
+	// Watch port events
+	events := make(chan portEvent, 32)
+	stopWatch := make(chan bool)
+	defer close(stopWatch)
+
+	scanInterval := monitorScanInterval
+	if err := watchPorts(events, stopWatch); err != nil {
+		log.Println("port events not available, polling serial ports:", err)
+		scanInterval = monitorPollInterval
+	}
+
+	scan := time.NewTimer(0)
+	defer scan.Stop()
+
+	check := time.NewTicker(monitorCheckInterval)
+	defer check.Stop()
+
+	noBoardSince := time.Now()
+
 	for {
 		select {
 		case <-IdeDetach:
 			return
-		default:
+
+		case event := <-events:
+			log.Println("port event:", event.action, event.dev)
+
+			if event.action == "remove" && connectedBoard != nil && connectedBoard.dev == event.dev {
+				boardDetached()
+			}
+
+			// Wait for more events before scanning
+			scan.Reset(monitorDebounce)
+
+		case <-check.C:
 			if Upgrading {
-				time.Sleep(time.Millisecond * 100)
+				noBoardSince = time.Now()
 				continue
 			}
 
-			// If a board is connected thest that is still connected
+			// If a board is connected test that is still connected
 			if connectedBoard != nil {
-				_, err := connectedBoard.port.InputWaiting()
-				if err != nil {
-					// Board is not connected, inform the IDE
-					connectedBoard.detach()
-
-					notify("boardDetached", "")
-					panic(err)
-				} else {
-					// Board is connected, check again later
-					tryLater()
-					continue
+				// The port is already closed if the attach failed
+				detached := connectedBoard.port == nil
+				if !detached {
+					_, err := connectedBoard.port.InputWaiting()
+					detached = err != nil
 				}
-			}
 
-			// In this point any board is connected, search for a board ...
+				if detached {
+					boardDetached()
+					scan.Reset(monitorDebounce)
+				}
 
-			// Enumerate all serial ports
-			ports, err := serial.ListPorts()
-			if err != nil {
-				log.Println("can't get serial ports")
-				tryLater()
-				continue
+				noBoardSince = time.Now()
+			} else if time.Since(noBoardSince) > monitorNoBoardInterval {
+				// No board found in the last seconds
+				notify("boardUpdate", "No board attached")
+				noBoardSince = time.Now()
 			}
 
-			// Search a serial port that matches with one of the supported adapters
-			skipFirst := false
-
-			for _, info := range ports {
-				// Read VID/PID
-				vendorId, productId, err := info.USBVIDPID()
-				if err != nil {
-					continue
+		case <-scan.C:
+			if !Upgrading && connectedBoard == nil {
+				if err := scanPorts(); err != nil {
+					log.Println("can't attach board:", err)
 				}
+			}
 
-				// We need a VID / PID
-				if vendorId != 0 && productId != 0 {
-					vendorId := "0x" + strconv.FormatInt(int64(vendorId), 16)
-					productId := "0x" + strconv.FormatInt(int64(productId), 16)
+			scan.Reset(scanInterval)
+		}
+	}
+}
 
-					log.Printf("found adapter, VID %s:%s (%s)", vendorId, productId, info.Name())
+// Board is not connected, inform the IDE. The commands waiting for the board
+// are interrupted first, so they release the board.
+func boardDetached() {
+	board := connectedBoard
+	if board == nil {
+		return
+	}
 
-					// Search a VID/PIN into requested devices
+	board.disconnected()
 
-					if (vendorId == "0x403") && (productId == "0x6010") {
-						log.Println("aaaaa")
-						if !skipFirst {
-							skipFirst = true
-							continue
-						}
-					}
+	BoardMutex.Lock()
+	defer BoardMutex.Unlock()
 
-					for _, device := range devices {
-						if device.VendorId == vendorId && device.ProductId == productId {
-							// This adapter matches
-							log.Printf("check adapter, VID %s:%s", device.VendorId, device.ProductId)
+	if connectedBoard == board {
+		board.detach()
+		notify("boardDetached", "")
+	}
+}
 
-							// Create a candidate board
-							var candidate Board
+// Search a serial port that matches with one of the device rules, and attach
+// it
+func scanPorts() error {
+	// Enumerate all USB serial ports
+	ports, err := listUSBPorts()
+	if err != nil {
+		log.Println("can't get serial ports")
+		return nil
+	}
 
-							// Attach candidate
-							candidate.maxBauds, _ = strconv.Atoi(device.MaxBauds)
+	rules := deviceRules()
 
-							candidate.attach(info)
+	// First board that failed to attach
+	var failed *Board
+	var failedPort *portInfo
 
-							if connectedBoard != nil {
-								break
-							}
-						}
-					}
+	for _, port := range ports {
+		log.Printf("found adapter, VID 0x%x:0x%x, interface %d (%s)", port.vendorId, port.productId, port.iface, port.name)
 
-					if connectedBoard != nil {
-						break
-					}
-				}
-			}
+		rule := matchDeviceRule(rules, port)
+		if rule == nil {
+			continue
+		}
 
-			if connectedBoard == nil {
-				tryLater()
+		// This adapter matches
+		log.Printf("check adapter, VID 0x%x:0x%x", port.vendorId, port.productId)
+
+		if err := attachPort(port.info, rule); err != nil {
+			log.Println("can't attach board:", err)
+
+			// Try the next ports, if any
+			BoardMutex.Lock()
+			if failed == nil && connectedBoard != nil {
+				failed, failedPort = connectedBoard, port
 			}
+			connectedBoard = nil
+			BoardMutex.Unlock()
+
+			continue
+		}
+
+		if connectedBoard != nil {
+			go Provisioning.attached(connectedBoard, port)
+			return nil
 		}
 	}
+
+	// Boards without a valid firmware remain attached, for install it
+	if failed != nil {
+		BoardMutex.Lock()
+		connectedBoard = failed
+		BoardMutex.Unlock()
+
+		go Provisioning.attached(failed, failedPort)
+	}
+
+	return nil
+}
+
+// Create a candidate board and attach it
+func attachPort(info *serial.Info, rule *DeviceRule) (err error) {
+	BoardMutex.Lock()
+	defer BoardMutex.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	var candidate Board
+
+	candidate.maxBauds = rule.MaxBauds
+	if candidate.maxBauds == 0 {
+		candidate.maxBauds = 115200
+	}
+
+	candidate.resetMethod = rule.Reset
+	candidate.attach(info)
+
+	return nil
 }
@@ -0,0 +1,386 @@
+/*
+ * Whitecat Blocky Environment, ESP32 panic decoding
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A decoded frame of a panic backtrace
+type PanicFrame struct {
+	Address  string `json:"address"`
+	Sp       string `json:"sp,omitempty"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// A board panic, as sent in the boardPanic notification
+type BoardPanic struct {
+	Core      int               `json:"core"`
+	Cause     string            `json:"cause"`
+	Pc        PanicFrame        `json:"pc"`
+	Registers map[string]string `json:"registers"`
+	Frames    []PanicFrame      `json:"frames"`
+	Dump      string            `json:"dump"`
+}
+
+var (
+	panicStartRe     = regexp.MustCompile(`^Guru Meditation Error: Core\s+(\d+) panic'ed \(([^)]*)\)`)
+	panicAbortRe     = regexp.MustCompile(`^abort\(\) was called at PC (0x[0-9a-fA-F]+) on core (\d+)`)
+	panicEndRe       = regexp.MustCompile(`^(Rebooting\.\.\.|CPU halted\.)$`)
+	panicRebootRe    = regexp.MustCompile(`^rst:`)
+	panicRegisterRe  = regexp.MustCompile(`([A-Z][A-Z0-9]*)\s*:\s*(0x[0-9a-fA-F]+)`)
+	panicBacktraceRe = regexp.MustCompile(`^Backtrace:(.*)$`)
+	panicFrameRe     = regexp.MustCompile(`(0x[0-9a-fA-F]+):(0x[0-9a-fA-F]+)`)
+)
+
+// Max number of lines of a panic dump
+const panicMaxLines = 100
+
+// Time to wait for more panic lines before sending the notification, for boards
+// that halts after a panic
+const panicIdleTimeout = 500 * time.Millisecond
+
+// Collects the lines of a panic dump received from a board
+type panicCollector struct {
+	mutex sync.Mutex
+	lines []string
+	timer *time.Timer
+}
+
+// Feed a line received from the board into the collector. Returns true if the
+// line is part of a panic dump.
+func (collector *panicCollector) feed(line string) bool {
+	var dump []string
+
+	// The dump is decoded once the collector is unlocked
+	defer func() {
+		if dump != nil {
+			go notifyPanic(dump)
+		}
+	}()
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if collector.lines == nil {
+		if !panicStartRe.MatchString(line) && !panicAbortRe.MatchString(line) {
+			return false
+		}
+
+		log.Println("board panic detected")
+
+		collector.lines = []string{line}
+		collector.timer = time.AfterFunc(panicIdleTimeout, collector.expire)
+
+		return true
+	}
+
+	if panicRebootRe.MatchString(line) {
+		// Board is rebooting, the line is not part of the dump
+		dump = collector.take()
+		return false
+	}
+
+	collector.lines = append(collector.lines, line)
+	collector.timer.Reset(panicIdleTimeout)
+
+	if panicEndRe.MatchString(line) || len(collector.lines) >= panicMaxLines {
+		dump = collector.take()
+	}
+
+	return true
+}
+
+func (collector *panicCollector) expire() {
+	collector.mutex.Lock()
+	dump := collector.take()
+	collector.mutex.Unlock()
+
+	if dump != nil {
+		notifyPanic(dump)
+	}
+}
+
+// Get the collected dump, and start a new one. Must be called with the mutex
+// held.
+func (collector *panicCollector) take() []string {
+	if collector.timer != nil {
+		collector.timer.Stop()
+	}
+
+	dump := collector.lines
+	collector.lines = nil
+
+	return dump
+}
+
+// Decode a dump and notify the IDE. The firmware's ELF can be large, so it
+// must be called without the collector locked.
+func notifyPanic(dump []string) {
+	boardPanic := decodePanic(dump)
+
+	info, err := json.Marshal(boardPanic)
+	if err == nil {
+		notify("boardPanic", string(info))
+	}
+}
+
+// Decode a panic dump
+func decodePanic(lines []string) *BoardPanic {
+	boardPanic := &BoardPanic{
+		Registers: make(map[string]string),
+		Frames:    []PanicFrame{},
+		Dump:      base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n"))),
+	}
+
+	if parts := panicStartRe.FindStringSubmatch(lines[0]); parts != nil {
+		boardPanic.Core, _ = strconv.Atoi(parts[1])
+		boardPanic.Cause = parts[2]
+	} else if parts := panicAbortRe.FindStringSubmatch(lines[0]); parts != nil {
+		boardPanic.Core, _ = strconv.Atoi(parts[2])
+		boardPanic.Cause = "abort"
+		boardPanic.Registers["PC"] = parts[1]
+	}
+
+	for _, line := range lines[1:] {
+		if parts := panicBacktraceRe.FindStringSubmatch(line); parts != nil {
+			for _, frame := range panicFrameRe.FindAllStringSubmatch(parts[1], -1) {
+				boardPanic.Frames = append(boardPanic.Frames, PanicFrame{Address: frame[1], Sp: frame[2]})
+			}
+
+			continue
+		}
+
+		for _, register := range panicRegisterRe.FindAllStringSubmatch(line, -1) {
+			boardPanic.Registers[register[1]] = register[2]
+		}
+	}
+
+	boardPanic.Pc.Address = boardPanic.Registers["PC"]
+
+	// Symbolicate addresses, if the firmware's ELF is available
+	symbolizer, err := firmwareSymbolizer()
+	if err != nil {
+		log.Println("can't symbolicate panic", err)
+		return boardPanic
+	}
+
+	symbolizer.symbolicate(&boardPanic.Pc)
+	for i := range boardPanic.Frames {
+		symbolizer.symbolicate(&boardPanic.Frames[i])
+	}
+
+	return boardPanic
+}
+
+/*
+ * Symbolication
+ */
+
+type elfLine struct {
+	address uint64
+	file    string
+	line    int
+	end     bool
+}
+
+type elfSymbolizer struct {
+	file    string
+	modTime time.Time
+	symbols []elf.Symbol
+	lines   []elfLine
+}
+
+var lastSymbolizer *elfSymbolizer
+var symbolizerMutex sync.Mutex
+
+// Get the ELF file of the firmware. The ELF file can be set in the config file,
+// if not, the first ELF file of the last downloaded firmware is used.
+func firmwareELF() string {
+	if AgentConfig.FirmwareELF != "" {
+		return AgentConfig.FirmwareELF
+	}
+
+	files, _ := filepath.Glob(path.Join(AppDataTmpFolder, "firmware_files", "*.elf"))
+	if len(files) > 0 {
+		return files[0]
+	}
+
+	return ""
+}
+
+// Get a symbolizer for the firmware's ELF. The last symbolizer is reused if
+// the ELF file has not changed.
+func firmwareSymbolizer() (*elfSymbolizer, error) {
+	symbolizerMutex.Lock()
+	defer symbolizerMutex.Unlock()
+
+	file := firmwareELF()
+	if file == "" {
+		return nil, errors.New("firmware ELF not found")
+	}
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastSymbolizer != nil && lastSymbolizer.file == file && lastSymbolizer.modTime.Equal(stat.ModTime()) {
+		return lastSymbolizer, nil
+	}
+
+	symbolizer, err := newElfSymbolizer(file)
+	if err != nil {
+		return nil, err
+	}
+
+	symbolizer.modTime = stat.ModTime()
+	lastSymbolizer = symbolizer
+
+	return symbolizer, nil
+}
+
+func newElfSymbolizer(file string) (*elfSymbolizer, error) {
+	f, err := elf.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	symbolizer := &elfSymbolizer{file: file}
+
+	// Function symbols, sorted by address
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && symbol.Value != 0 {
+			symbolizer.symbols = append(symbolizer.symbols, symbol)
+		}
+	}
+
+	sort.Slice(symbolizer.symbols, func(i, j int) bool {
+		return symbolizer.symbols[i].Value < symbolizer.symbols[j].Value
+	})
+
+	// Line table, sorted by address. Line information is optional.
+	data, err := f.DWARF()
+	if err != nil {
+		log.Println("no debug information in " + file)
+		return symbolizer, nil
+	}
+
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil || entry == nil {
+			break
+		}
+
+		if entry.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+			continue
+		}
+
+		lineReader, err := data.LineReader(entry)
+		if err != nil || lineReader == nil {
+			continue
+		}
+
+		var lineEntry dwarf.LineEntry
+		for lineReader.Next(&lineEntry) == nil {
+			line := elfLine{
+				address: lineEntry.Address,
+				line:    lineEntry.Line,
+				end:     lineEntry.EndSequence,
+			}
+
+			if lineEntry.File != nil {
+				line.file = lineEntry.File.Name
+			}
+
+			symbolizer.lines = append(symbolizer.lines, line)
+		}
+	}
+
+	sort.SliceStable(symbolizer.lines, func(i, j int) bool {
+		return symbolizer.lines[i].address < symbolizer.lines[j].address
+	})
+
+	return symbolizer, nil
+}
+
+// Fill the function, file and line of a frame
+func (symbolizer *elfSymbolizer) symbolicate(frame *PanicFrame) {
+	address, err := strconv.ParseUint(strings.TrimPrefix(frame.Address, "0x"), 16, 32)
+	if err != nil {
+		return
+	}
+
+	// Find the function containing the address
+	i := sort.Search(len(symbolizer.symbols), func(i int) bool {
+		return symbolizer.symbols[i].Value > address
+	}) - 1
+
+	if i >= 0 {
+		symbol := symbolizer.symbols[i]
+		if address < symbol.Value+symbol.Size || symbol.Size == 0 {
+			frame.Function = symbol.Name
+		}
+	}
+
+	// Find the source line
+	i = sort.Search(len(symbolizer.lines), func(i int) bool {
+		return symbolizer.lines[i].address > address
+	}) - 1
+
+	if i >= 0 && !symbolizer.lines[i].end {
+		frame.File = symbolizer.lines[i].file
+		frame.Line = symbolizer.lines[i].line
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Whitecat Blocky Environment, panic decoder tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Read a captured panic dump
+func panicDump(t *testing.T, file string) []string {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "panic", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+}
+
+func TestDecodePanic(t *testing.T) {
+	defer func(elf string) {
+		AgentConfig.FirmwareELF = elf
+	}(AgentConfig.FirmwareELF)
+
+	// Without symbols
+	AgentConfig.FirmwareELF = filepath.Join("testdata", "panic", "missing.elf")
+
+	lines := panicDump(t, "loadprohibited.log")
+	boardPanic := decodePanic(lines)
+
+	if boardPanic.Core != 1 || boardPanic.Cause != "LoadProhibited" {
+		t.Errorf("unexpected core %d, cause %q", boardPanic.Core, boardPanic.Cause)
+	}
+
+	if boardPanic.Pc.Address != "0x400d2b8e" {
+		t.Errorf("unexpected pc %q", boardPanic.Pc.Address)
+	}
+
+	for register, value := range map[string]string{"A0": "0x800d1f6c", "EXCCAUSE": "0x0000001c", "EXCVADDR": "0x00000000", "LCOUNT": "0xfffffffb"} {
+		if boardPanic.Registers[register] != value {
+			t.Errorf("register %s is %q, expected %q", register, boardPanic.Registers[register], value)
+		}
+	}
+
+	frames := []PanicFrame{
+		{Address: "0x400d2b8e", Sp: "0x3ffb1f50"},
+		{Address: "0x400d1f69", Sp: "0x3ffb1f80"},
+		{Address: "0x40088b7d", Sp: "0x3ffb1fb0"},
+	}
+
+	if len(boardPanic.Frames) != len(frames) {
+		t.Fatalf("unexpected frames %v", boardPanic.Frames)
+	}
+
+	for i, frame := range frames {
+		if boardPanic.Frames[i] != frame {
+			t.Errorf("frame %d is %v, expected %v", i, boardPanic.Frames[i], frame)
+		}
+	}
+
+	if dump, err := base64.StdEncoding.DecodeString(boardPanic.Dump); err != nil || string(dump) != strings.Join(lines, "\n") {
+		t.Errorf("unexpected dump %q", boardPanic.Dump)
+	}
+}
+
+func TestDecodePanicAbort(t *testing.T) {
+	defer func(elf string) {
+		AgentConfig.FirmwareELF = elf
+	}(AgentConfig.FirmwareELF)
+
+	AgentConfig.FirmwareELF = filepath.Join("testdata", "panic", "missing.elf")
+
+	boardPanic := decodePanic([]string{
+		"abort() was called at PC 0x400d3f1a on core 0",
+		"",
+		"Backtrace: 0x40087c9c:0x3ffb5d90 0x40087ecd:0x3ffb5db0",
+	})
+
+	if boardPanic.Core != 0 || boardPanic.Cause != "abort" || boardPanic.Pc.Address != "0x400d3f1a" || len(boardPanic.Frames) != 2 {
+		t.Errorf("unexpected panic %+v", boardPanic)
+	}
+}
+
+func TestPanicCollector(t *testing.T) {
+	collector := &panicCollector{}
+
+	if collector.feed("I (123) boot: normal line") {
+		t.Error("normal line taken as a panic")
+	}
+
+	for _, line := range panicDump(t, "loadprohibited.log") {
+		if !collector.feed(line) {
+			t.Errorf("line %q not taken as a panic", line)
+		}
+	}
+
+	// The dump ends with Rebooting...
+	if collector.lines != nil {
+		t.Errorf("dump not finished, %d lines", len(collector.lines))
+	}
+
+	if collector.feed("rst:0xc (SW_CPU_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)") {
+		t.Error("reboot line taken as a panic")
+	}
+}
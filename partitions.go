@@ -0,0 +1,486 @@
+/*
+ * Whitecat Blocky Environment, partition tables
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Partition table location in flash
+const partitionTableOffset = 0x8000
+const partitionTableSize = 0xc00
+
+const partitionEntrySize = 32
+const partitionMagic = 0x50aa
+const partitionMD5Magic = 0xebeb
+
+// Bauds used by esptool for the partition commands
+const partitionBauds = "921600"
+
+const partitionEncrypted = 1
+
+var partitionTypes = map[string]uint8{
+	"app":  0x00,
+	"data": 0x01,
+}
+
+var partitionSubTypes = map[uint8]map[string]uint8{
+	0x00: {
+		"factory": 0x00,
+		"test":    0x20,
+	},
+	0x01: {
+		"ota":      0x00,
+		"phy":      0x01,
+		"nvs":      0x02,
+		"coredump": 0x03,
+		"nvs_keys": 0x04,
+		"efuse":    0x05,
+		"esphttpd": 0x80,
+		"fat":      0x81,
+		"spiffs":   0x82,
+		"littlefs": 0x83,
+	},
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		partitionSubTypes[0x00]["ota_"+strconv.Itoa(i)] = uint8(0x10 + i)
+	}
+}
+
+// A partition table entry
+type Partition struct {
+	Label     string `json:"label"`
+	Type      string `json:"type"`
+	SubType   string `json:"subType"`
+	Offset    uint32 `json:"offset"`
+	Size      uint32 `json:"size"`
+	Encrypted bool   `json:"encrypted"`
+
+	typeId    uint8
+	subTypeId uint8
+}
+
+func partitionTypeName(typeId uint8) string {
+	for name, id := range partitionTypes {
+		if id == typeId {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("0x%02x", typeId)
+}
+
+func partitionSubTypeName(typeId uint8, subTypeId uint8) string {
+	for name, id := range partitionSubTypes[typeId] {
+		if id == subTypeId {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("0x%02x", subTypeId)
+}
+
+// Decode a binary partition table
+func decodePartitionTable(b []byte) ([]Partition, error) {
+	var partitions []Partition
+
+entries:
+	for i := 0; i+partitionEntrySize <= len(b); i = i + partitionEntrySize {
+		entry := b[i : i+partitionEntrySize]
+
+		switch binary.LittleEndian.Uint16(entry) {
+		case partitionMagic:
+			p := Partition{
+				typeId:    entry[2],
+				subTypeId: entry[3],
+				Offset:    binary.LittleEndian.Uint32(entry[4:]),
+				Size:      binary.LittleEndian.Uint32(entry[8:]),
+				Label:     string(bytes.TrimRight(entry[12:28], "\x00")),
+				Encrypted: binary.LittleEndian.Uint32(entry[28:])&partitionEncrypted != 0,
+			}
+
+			p.Type = partitionTypeName(p.typeId)
+			p.SubType = partitionSubTypeName(p.typeId, p.subTypeId)
+
+			partitions = append(partitions, p)
+
+		case partitionMD5Magic:
+			sum := md5.Sum(b[:i])
+			if !bytes.Equal(sum[:], entry[16:]) {
+				return nil, errors.New("partition table MD5 mismatch")
+			}
+
+			break entries
+
+		case 0xffff:
+			break entries
+
+		default:
+			return nil, fmt.Errorf("invalid partition table entry at 0x%x", i)
+		}
+	}
+
+	if partitions == nil {
+		return nil, errors.New("empty partition table")
+	}
+
+	return partitions, nil
+}
+
+// Encode a binary partition table
+func encodePartitionTable(partitions []Partition) ([]byte, error) {
+	var b []byte
+
+	if (len(partitions)+1)*partitionEntrySize > partitionTableSize {
+		return nil, errors.New("too many partitions")
+	}
+
+	for _, p := range partitions {
+		entry := make([]byte, partitionEntrySize)
+
+		binary.LittleEndian.PutUint16(entry, partitionMagic)
+		entry[2] = p.typeId
+		entry[3] = p.subTypeId
+		binary.LittleEndian.PutUint32(entry[4:], p.Offset)
+		binary.LittleEndian.PutUint32(entry[8:], p.Size)
+		copy(entry[12:28], p.Label)
+
+		if p.Encrypted {
+			binary.LittleEndian.PutUint32(entry[28:], partitionEncrypted)
+		}
+
+		b = append(b, entry...)
+	}
+
+	// MD5 entry
+	sum := md5.Sum(b)
+	entry := bytes.Repeat([]byte{0xff}, partitionEntrySize)
+	binary.LittleEndian.PutUint16(entry, partitionMD5Magic)
+	copy(entry[16:], sum[:])
+	b = append(b, entry...)
+
+	return append(b, bytes.Repeat([]byte{0xff}, partitionTableSize-len(b))...), nil
+}
+
+// Parse a number of a partition CSV, that can be decimal or hexadecimal, with
+// an optional K or M suffix
+func parsePartitionNumber(value string) (uint32, error) {
+	multiplier := uint64(1)
+
+	switch {
+	case strings.HasSuffix(strings.ToUpper(value), "K"):
+		multiplier = 1024
+		value = value[:len(value)-1]
+	case strings.HasSuffix(strings.ToUpper(value), "M"):
+		multiplier = 1024 * 1024
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, errors.New("invalid number " + value)
+	}
+
+	return uint32(n * multiplier), nil
+}
+
+func align(value uint32, alignment uint32) uint32 {
+	return (value + alignment - 1) / alignment * alignment
+}
+
+// Parse a partition table in CSV format (name, type, subtype, offset, size,
+// flags), as used by the ESP-IDF. Empty offsets are calculated from the
+// previous partition.
+func parsePartitionCSV(text string) ([]Partition, error) {
+	var partitions []Partition
+
+	// Remove comments
+	text = regexp.MustCompile(`(?m)#.*$`).ReplaceAllString(text, "")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	next := uint32(partitionTableOffset + 0x1000)
+
+	for line, record := range records {
+		for len(record) < 6 {
+			record = append(record, "")
+		}
+
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		if record[0] == "" {
+			continue
+		}
+
+		fail := func(msg string) error {
+			return fmt.Errorf("partition %s (record %d): %s", record[0], line+1, msg)
+		}
+
+		if len(record[0]) > 16 {
+			return nil, fail("name is too long")
+		}
+
+		p := Partition{Label: record[0]}
+
+		// Type
+		if id, ok := partitionTypes[record[1]]; ok {
+			p.typeId = id
+		} else if n, err := strconv.ParseUint(record[1], 0, 8); err == nil {
+			p.typeId = uint8(n)
+		} else {
+			return nil, fail("invalid type " + record[1])
+		}
+
+		// Subtype
+		if id, ok := partitionSubTypes[p.typeId][record[2]]; ok {
+			p.subTypeId = id
+		} else if n, err := strconv.ParseUint(record[2], 0, 8); err == nil {
+			p.subTypeId = uint8(n)
+		} else {
+			return nil, fail("invalid subtype " + record[2])
+		}
+
+		p.Type = partitionTypeName(p.typeId)
+		p.SubType = partitionSubTypeName(p.typeId, p.subTypeId)
+
+		// App partitions must be aligned to 64K
+		alignment := uint32(0x1000)
+		if p.typeId == partitionTypes["app"] {
+			alignment = 0x10000
+		}
+
+		// Offset
+		if record[3] == "" {
+			p.Offset = align(next, alignment)
+		} else if p.Offset, err = parsePartitionNumber(record[3]); err != nil {
+			return nil, fail(err.Error())
+		}
+
+		if p.Offset%alignment != 0 {
+			return nil, fail(fmt.Sprintf("offset 0x%x is not aligned to 0x%x", p.Offset, alignment))
+		}
+
+		if p.Offset < next {
+			return nil, fail(fmt.Sprintf("offset 0x%x overlaps the previous partition", p.Offset))
+		}
+
+		// Size
+		if p.Size, err = parsePartitionNumber(record[4]); err != nil {
+			return nil, fail(err.Error())
+		}
+
+		if p.Size == 0 {
+			return nil, fail("size is 0")
+		}
+
+		// Flags
+		for _, flag := range strings.Split(record[5], ":") {
+			switch strings.TrimSpace(flag) {
+			case "":
+			case "encrypted":
+				p.Encrypted = true
+			default:
+				return nil, fail("unknown flag " + flag)
+			}
+		}
+
+		next = p.Offset + p.Size
+
+		partitions = append(partitions, p)
+	}
+
+	if partitions == nil {
+		return nil, errors.New("empty partition table")
+	}
+
+	return partitions, nil
+}
+
+// Read a partition table from a binary or CSV file
+func readPartitionTable(file string) ([]Partition, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(strings.ToLower(file), ".csv") {
+		return parsePartitionCSV(string(b))
+	}
+
+	return decodePartitionTable(b)
+}
+
+func findPartition(partitions []Partition, label string) (Partition, bool) {
+	for _, p := range partitions {
+		if p.Label == label {
+			return p, true
+		}
+	}
+
+	return Partition{}, false
+}
+
+// Get the partition table of a firmware folder, that is the image that is
+// flashed at the partition table offset
+func firmwarePartitionTable(folder string) ([]Partition, error) {
+	b, err := ioutil.ReadFile(path.Join(folder, "flash_args"))
+	if err != nil {
+		return nil, err
+	}
+
+	args := regexp.MustCompile(`'.*?'|".*?"|\S+`).FindAllString(string(b), -1)
+
+	for i := 0; i+1 < len(args); i++ {
+		if offset, err := strconv.ParseUint(args[i], 0, 32); err == nil && offset == partitionTableOffset {
+			return readPartitionTable(path.Join(folder, strings.Trim(args[i+1], "\"'")))
+		}
+	}
+
+	return nil, errors.New("partition table not found in firmware")
+}
+
+// Run f with the board detached, and esptool ready to use. The monitor
+// attaches the board again when finished.
+func (board *Board) withEsptool(f func() error) error {
+	Upgrading = true
+	defer func() {
+		Upgrading = false
+	}()
+
+	// First detach board for free serial port
+	board.detach()
+
+	// Download tool for flashing
+	if err := downloadEsptool(); err != nil {
+		return err
+	}
+
+	return f()
+}
+
+// Read the partition table from the board. Must be called with esptool ready.
+func (board *Board) readPartitionTable() ([]Partition, error) {
+	file := path.Join(AppDataTmpFolder, "partitions.bin")
+	os.Remove(file)
+
+	err := board.esptool("--baud", partitionBauds, "read_flash", fmt.Sprintf("0x%x", partitionTableOffset), fmt.Sprintf("0x%x", partitionTableSize), file)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPartitionTable(file)
+}
+
+// Get the partition table of the board
+func (board *Board) getPartitions() (partitions []Partition, err error) {
+	err = board.withEsptool(func() error {
+		partitions, err = board.readPartitionTable()
+		return err
+	})
+
+	return partitions, err
+}
+
+// Flash a partition table, from a binary or CSV file
+func (board *Board) flashPartitionTable(file string) error {
+	partitions, err := readPartitionTable(file)
+	if err != nil {
+		return err
+	}
+
+	b, err := encodePartitionTable(partitions)
+	if err != nil {
+		return err
+	}
+
+	table := path.Join(AppDataTmpFolder, "partitions.bin")
+	if err = ioutil.WriteFile(table, b, 0666); err != nil {
+		return err
+	}
+
+	return board.withEsptool(func() error {
+		return board.esptool("--baud", partitionBauds, "write_flash", fmt.Sprintf("0x%x", partitionTableOffset), table)
+	})
+}
+
+// Flash a file in a partition of the board, using the board's partition table
+func (board *Board) flashPartition(label string, file string) error {
+	finfo, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	return board.withEsptool(func() error {
+		partitions, err := board.readPartitionTable()
+		if err != nil {
+			return err
+		}
+
+		p, ok := findPartition(partitions, label)
+		if !ok {
+			return errors.New("partition " + label + " not found")
+		}
+
+		if finfo.Size() > int64(p.Size) {
+			return fmt.Errorf("%s doesn't fit in partition %s (%d bytes)", path.Base(file), label, p.Size)
+		}
+
+		// Encrypted partitions are encrypted by the chip while flashing, the
+		// file must be in plain text
+		args := []string{"--baud", partitionBauds, "write_flash"}
+		if p.Encrypted {
+			args = append(args, "--encrypt")
+		}
+
+		return board.esptool(append(args, fmt.Sprintf("0x%x", p.Offset), file)...)
+	})
+}
@@ -0,0 +1,105 @@
+/*
+ * Whitecat Blocky Environment, partition table tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPartitionTableRoundTrip(t *testing.T) {
+	partitions, err := readPartitionTable(filepath.Join("testdata", "partitions", "partitions.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Partition{
+		{Label: "nvs", Type: "data", SubType: "nvs", Offset: 0x9000, Size: 0x6000, typeId: 0x01, subTypeId: 0x02},
+		{Label: "phy_init", Type: "data", SubType: "phy", Offset: 0xf000, Size: 0x1000, typeId: 0x01, subTypeId: 0x01},
+		{Label: "factory", Type: "app", SubType: "factory", Offset: 0x10000, Size: 0x100000, typeId: 0x00, subTypeId: 0x00},
+		{Label: "ota_0", Type: "app", SubType: "ota_0", Offset: 0x110000, Size: 0x100000, Encrypted: true, typeId: 0x00, subTypeId: 0x10},
+		{Label: "storage", Type: "data", SubType: "spiffs", Offset: 0x210000, Size: 0x80000, typeId: 0x01, subTypeId: 0x82},
+	}
+
+	if !reflect.DeepEqual(partitions, expected) {
+		t.Fatalf("unexpected partitions from CSV\n%+v\nexpected\n%+v", partitions, expected)
+	}
+
+	b, err := encodePartitionTable(partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != partitionTableSize {
+		t.Fatalf("binary table is %d bytes, expected %d", len(b), partitionTableSize)
+	}
+
+	decoded, err := decodePartitionTable(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("unexpected partitions from binary\n%+v\nexpected\n%+v", decoded, expected)
+	}
+}
+
+func TestPartitionTableMD5(t *testing.T) {
+	partitions, err := readPartitionTable(filepath.Join("testdata", "partitions", "partitions.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := encodePartitionTable(partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The MD5 entry follows the partitions, and has the MD5 of all of them
+	entry := b[len(partitions)*partitionEntrySize:][:partitionEntrySize]
+
+	if binary.LittleEndian.Uint16(entry) != partitionMD5Magic {
+		t.Fatalf("MD5 entry magic is 0x%04x", binary.LittleEndian.Uint16(entry))
+	}
+
+	sum := md5.Sum(b[:len(partitions)*partitionEntrySize])
+	if !reflect.DeepEqual(entry[16:], sum[:]) {
+		t.Errorf("MD5 entry is %x, expected %x", entry[16:], sum)
+	}
+
+	// A corrupted table must be refused
+	b[4] ^= 0x01
+	if _, err := decodePartitionTable(b); err == nil || err.Error() != "partition table MD5 mismatch" {
+		t.Errorf("corrupted table decoded, error %v", err)
+	}
+}
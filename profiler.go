@@ -0,0 +1,252 @@
+/*
+ * Whitecat Blocky Environment, block execution profiler
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Max number of trace events kept for a run
+const profilerMaxEvents = 200000
+
+// Execution statistics of a block
+type BlockStats struct {
+	Block   string  `json:"block"`
+	Count   int     `json:"count"`
+	Errors  int     `json:"errors"`
+	TotalMs float64 `json:"totalMs"`
+	MinMs   float64 `json:"minMs"`
+	MaxMs   float64 `json:"maxMs"`
+	MeanMs  float64 `json:"meanMs"`
+}
+
+// A block that has started but not ended yet
+type ActiveBlock struct {
+	Block     string  `json:"block"`
+	ElapsedMs float64 `json:"elapsedMs"`
+}
+
+// Profile report of a run
+type ProfileReport struct {
+	Started   time.Time     `json:"started"`
+	ElapsedMs float64       `json:"elapsedMs"`
+	Blocks    []BlockStats  `json:"blocks"`
+	Active    []ActiveBlock `json:"active"`
+	Truncated bool          `json:"truncated"`
+}
+
+// An event in the Chrome trace event format
+type TraceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	S    string            `json:"s,omitempty"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// Aggregates the blockStart / blockEnd / blockError events of a run
+type blockProfiler struct {
+	mutex sync.Mutex
+
+	started   time.Time
+	events    []TraceEvent
+	truncated bool
+	stats     map[string]*BlockStats
+
+	// Start time of the active executions of each block
+	active map[string][]time.Time
+}
+
+func newBlockProfiler() *blockProfiler {
+	profiler := &blockProfiler{}
+	profiler.reset()
+
+	return profiler
+}
+
+// Start a new run
+func (profiler *blockProfiler) reset() {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	profiler.started = time.Now()
+	profiler.events = nil
+	profiler.truncated = false
+	profiler.stats = make(map[string]*BlockStats)
+	profiler.active = make(map[string][]time.Time)
+}
+
+// Add a trace event. Must be called with the mutex held.
+func (profiler *blockProfiler) trace(block string, ph string, when time.Time, args map[string]string) {
+	if len(profiler.events) >= profilerMaxEvents {
+		profiler.truncated = true
+		return
+	}
+
+	event := TraceEvent{
+		Name: block,
+		Cat:  "block",
+		Ph:   ph,
+		Ts:   when.Sub(profiler.started).Nanoseconds() / 1000,
+		Pid:  1,
+		Tid:  1,
+		Args: args,
+	}
+
+	if ph == "i" {
+		event.S = "t"
+	}
+
+	profiler.events = append(profiler.events, event)
+}
+
+// Get the stats of a block. Must be called with the mutex held.
+func (profiler *blockProfiler) blockStats(block string) *BlockStats {
+	stats, ok := profiler.stats[block]
+	if !ok {
+		stats = &BlockStats{Block: base64.StdEncoding.EncodeToString([]byte(block))}
+		profiler.stats[block] = stats
+	}
+
+	return stats
+}
+
+func (profiler *blockProfiler) blockStart(block string) {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	now := time.Now()
+
+	profiler.active[block] = append(profiler.active[block], now)
+	profiler.trace(block, "B", now, nil)
+}
+
+func (profiler *blockProfiler) blockEnd(block string) {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	now := time.Now()
+
+	starts := profiler.active[block]
+	if len(starts) == 0 {
+		// End without start, probably the run started before the profiler
+		return
+	}
+
+	started := starts[len(starts)-1]
+	if len(starts) == 1 {
+		delete(profiler.active, block)
+	} else {
+		profiler.active[block] = starts[:len(starts)-1]
+	}
+
+	elapsed := float64(now.Sub(started).Nanoseconds()) / 1e6
+
+	stats := profiler.blockStats(block)
+	if stats.Count == 0 || elapsed < stats.MinMs {
+		stats.MinMs = elapsed
+	}
+	if elapsed > stats.MaxMs {
+		stats.MaxMs = elapsed
+	}
+	stats.Count++
+	stats.TotalMs = stats.TotalMs + elapsed
+	stats.MeanMs = stats.TotalMs / float64(stats.Count)
+
+	profiler.trace(block, "E", now, nil)
+}
+
+func (profiler *blockProfiler) blockError(block string, message string) {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	profiler.blockStats(block).Errors++
+	profiler.trace(block, "i", time.Now(), map[string]string{"error": message})
+}
+
+// Get the profile report, with blocks sorted by total execution time
+func (profiler *blockProfiler) report() *ProfileReport {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	now := time.Now()
+
+	report := &ProfileReport{
+		Started:   profiler.started,
+		ElapsedMs: float64(now.Sub(profiler.started).Nanoseconds()) / 1e6,
+		Blocks:    []BlockStats{},
+		Active:    []ActiveBlock{},
+		Truncated: profiler.truncated,
+	}
+
+	for _, stats := range profiler.stats {
+		report.Blocks = append(report.Blocks, *stats)
+	}
+
+	sort.Slice(report.Blocks, func(i, j int) bool {
+		return report.Blocks[i].TotalMs > report.Blocks[j].TotalMs
+	})
+
+	for block, starts := range profiler.active {
+		report.Active = append(report.Active, ActiveBlock{
+			Block:     base64.StdEncoding.EncodeToString([]byte(block)),
+			ElapsedMs: float64(now.Sub(starts[0]).Nanoseconds()) / 1e6,
+		})
+	}
+
+	sort.Slice(report.Active, func(i, j int) bool {
+		return report.Active[i].ElapsedMs > report.Active[j].ElapsedMs
+	})
+
+	return report
+}
+
+// Get the trace of the run, in the Chrome trace event format
+func (profiler *blockProfiler) chromeTrace() ([]byte, error) {
+	profiler.mutex.Lock()
+	defer profiler.mutex.Unlock()
+
+	events := profiler.events
+	if events == nil {
+		events = []TraceEvent{}
+	}
+
+	return json.Marshal(struct {
+		TraceEvents     []TraceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
@@ -0,0 +1,365 @@
+/*
+ * Whitecat Blocky Environment, projects
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Folder in the board for the Lua modules
+const projectModulesFolder = "/lib/lua"
+
+var requireRe = regexp.MustCompile(`\brequire\s*\(?\s*["']([^"']+)["']`)
+var dofileRe = regexp.MustCompile(`\b(?:dofile|loadfile)\s*\(?\s*["']([^"']+)["']`)
+
+// A file of a project
+type projectFile struct {
+	// Local file
+	local string
+
+	// File in the board
+	remote string
+}
+
+// Get the local folders with the projects that the IDE can use
+func projectRoots() []string {
+	if len(AgentConfig.Projects.Roots) > 0 {
+		return AgentConfig.Projects.Roots
+	}
+
+	return []string{path.Join(AppDataFolder, "projects")}
+}
+
+// Test if file is inside folder, once the symbolic links are resolved
+func insideFolder(folder string, file string) bool {
+	folder, err := filepath.Abs(folder)
+	if err == nil {
+		folder, err = filepath.EvalSymlinks(folder)
+	}
+
+	if err != nil {
+		return false
+	}
+
+	file, err = filepath.Abs(file)
+	if err == nil {
+		file, err = filepath.EvalSymlinks(file)
+	}
+
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(folder, file)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Check that a local file requested by the IDE is inside one of the project
+// roots. The IDE can't use other files of the host.
+func checkLocalPath(file string) error {
+	for _, root := range projectRoots() {
+		if insideFolder(root, file) {
+			return nil
+		}
+	}
+
+	return errors.New(file + " is not inside a project folder")
+}
+
+// Find the files of a project, starting from the entry file. Modules loaded
+// with require are stored in /lib/lua, and files loaded with dofile are stored
+// with the path used in dofile, that the board resolves from the root folder,
+// and that is resolved from the entry's folder in the local folder. The entry
+// file is stored in the project folder. Dependencies not found in the local
+// folder are supposed to be modules of the firmware, and dependencies outside
+// the entry's folder are not allowed.
+func projectFiles(entry string, folder string) ([]projectFile, error) {
+	root := filepath.Dir(entry)
+
+	var files []projectFile
+
+	visited := make(map[string]bool)
+
+	var scan func(local string, remote string) error
+
+	scan = func(local string, remote string) error {
+		if visited[local] {
+			return nil
+		}
+
+		visited[local] = true
+
+		code, err := ioutil.ReadFile(local)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, projectFile{local: local, remote: remote})
+
+		// Modules
+		for _, match := range requireRe.FindAllStringSubmatch(string(code), -1) {
+			module := filepath.FromSlash(strings.Replace(match[1], ".", "/", -1))
+
+			for _, candidate := range []string{module + ".lua", filepath.Join(module, "init.lua")} {
+				if finfo, err := os.Stat(filepath.Join(root, candidate)); err == nil && !finfo.IsDir() {
+					if !insideFolder(root, filepath.Join(root, candidate)) {
+						return errors.New(match[1] + " is outside the project folder")
+					}
+
+					if err = scan(filepath.Join(root, candidate), path.Join(projectModulesFolder, filepath.ToSlash(candidate))); err != nil {
+						return err
+					}
+
+					break
+				}
+			}
+		}
+
+		// Files
+		for _, match := range dofileRe.FindAllStringSubmatch(string(code), -1) {
+			file := path.Clean("/" + match[1])
+
+			if finfo, err := os.Stat(filepath.Join(root, filepath.FromSlash(file))); err == nil && !finfo.IsDir() {
+				if !insideFolder(root, filepath.Join(root, filepath.FromSlash(file))) {
+					return errors.New(match[1] + " is outside the project folder")
+				}
+
+				if err = scan(filepath.Join(root, filepath.FromSlash(file)), file); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := scan(entry, path.Join(folder, filepath.Base(entry))); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// A file uploaded to a board
+type uploadedFile struct {
+	// Hash of the local file
+	hash string
+
+	// Size of the file in the board
+	size int
+
+	// Source map, if the line numbers have changed when uploaded
+	sourceMap []int
+}
+
+// Files uploaded to each board, by board key and path
+type uploadCache struct {
+	mutex sync.Mutex
+	files map[string]map[string]uploadedFile
+}
+
+var Uploads = &uploadCache{files: make(map[string]map[string]uploadedFile)}
+
+func (cache *uploadCache) get(key string, path string) (uploadedFile, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	file, ok := cache.files[key][path]
+
+	return file, ok
+}
+
+func (cache *uploadCache) set(key string, path string, file uploadedFile) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.files[key] == nil {
+		cache.files[key] = make(map[string]uploadedFile)
+	}
+
+	cache.files[key][path] = file
+}
+
+// Get the size of a file in the board, or -1 if the file doesn't exist
+func (board *Board) fileSize(path string) int {
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(2000)
+	resp := board.sendCommand(luaWithAttributes(path, "print(att ~= nil and att.type == \"file\" and att.size or -1);"))
+	board.noTimeout()
+	board.consoleOut = true
+	board.consoleIn = false
+
+	size, err := strconv.Atoi(strings.TrimSpace(resp))
+	if err != nil {
+		return -1
+	}
+
+	return size
+}
+
+// Create a folder in the board, and its parents
+func (board *Board) makeDirs(dir string) {
+	current := ""
+
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		current = current + "/" + part
+
+		board.consoleOut = false
+		board.consoleIn = true
+		board.timeout(2000)
+		board.sendCommand(luaWithAttributes(current, "if att == nil then "+luaCall("os.mkdir", current)+" end;"))
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+	}
+}
+
+// Upload the files of a project that are missing in the board, or that have
+// changed since they were uploaded. Returns the number of uploaded files.
+func (board *Board) uploadProject(files []projectFile) (int, error) {
+	key := board.inventoryKey
+	if key == "" {
+		key = board.dev
+	}
+
+	uploaded := 0
+	dirs := make(map[string]bool)
+
+	for _, file := range files {
+		code, err := ioutil.ReadFile(file.local)
+		if err != nil {
+			return uploaded, err
+		}
+
+		sum := sha1.Sum(code)
+		hash := hex.EncodeToString(sum[:])
+
+		if cached, ok := Uploads.get(key, file.remote); ok && cached.hash == hash && board.fileSize(file.remote) == cached.size {
+			// Keep the source, for show the context of errors
+			board.sources.set(file.remote, code)
+			board.sources.setMap(file.remote, cached.sourceMap)
+			continue
+		}
+
+		if dir := path.Dir(file.remote); !dirs[dir] {
+			board.makeDirs(dir)
+			dirs[dir] = true
+		}
+
+		log.Println("Sending ", file.remote, " ...")
+		notify("boardUpdate", "Uploading "+file.remote)
+
+		if board.uploadFile(file.remote, code) == "" {
+			return uploaded, errors.New("can't write " + file.remote)
+		}
+
+		// Files can be transformed when uploaded, so get the size from the board
+		Uploads.set(key, file.remote, uploadedFile{
+			hash:      hash,
+			size:      board.fileSize(file.remote),
+			sourceMap: board.sources.getMap(file.remote),
+		})
+
+		uploaded++
+	}
+
+	return uploaded, nil
+}
+
+// Upload a project and run its entry file. Returns the run id.
+func (board *Board) runProject(entry string, folder string, mode string) (id int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if folder == "" {
+		folder = "/"
+	}
+
+	files, err := projectFiles(entry, folder)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		log.Println("project file: ", file.local, "->", file.remote)
+
+		// Check all the files, before stop the running program
+		code, err := ioutil.ReadFile(file.local)
+		if err != nil {
+			return 0, err
+		}
+
+		if err = board.checkLua(file.remote, code); err != nil {
+			return 0, err
+		}
+	}
+
+	board.resetForRun()
+
+	// The entry file is written when the program is started
+	uploaded, err := board.uploadProject(files[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	log.Println(strconv.Itoa(uploaded) + " files uploaded")
+
+	code, err := ioutil.ReadFile(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	if dir := path.Dir(files[0].remote); dir != "/" {
+		board.makeDirs(dir)
+	}
+
+	return board.startProgram(files[0].remote, code, mode)
+}
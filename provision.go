@@ -0,0 +1,575 @@
+/*
+ * Whitecat Blocky Environment, production provisioning
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+A provisioning job is defined in a JSON file. Each matching board that is
+plugged in is flashed, the files are uploaded, and the self-test is run. Then
+a report is written in the provisioning folder of the user data folder.
+
+Example:
+
+{
+	"Name": "sensor-node",
+	"Devices": [{"VendorId": "0x10c4", "ProductId": "0xea60"}],
+	"Firmware": "WHITECAT-ESP32-N1",
+	"Files": "/home/user/sensor-node/fs",
+	"FilesystemImage": true,
+	"Test": "dofile(\"/selftest.lua\")",
+	"Expect": "^selftest ok$",
+	"TestTimeout": 20000
+}
+
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default self-test timeout, in milliseconds
+const provisioningTestTimeout = 10000
+
+// Characters that can't be in a report file name
+var reportNameRe = regexp.MustCompile(`[^0-9A-Za-z_.-]`)
+
+type ProvisioningJob struct {
+	Name string
+
+	// Boards that are provisioned. If empty, all boards are provisioned.
+	Devices []DeviceRule
+
+	// Firmware to flash, from the firmware repository, or from a local
+	// folder with flash_args / flashfs_args and the images. If both are empty
+	// the firmware is not flashed.
+	Firmware string
+	Image    string
+
+	// Local folder to upload to the board's filesystem. If FilesystemImage
+	// is true a filesystem image is built and flashed, instead of uploading
+	// each file.
+	Files           string
+	FilesystemImage bool
+
+	// Self-test Lua command, and a regular expression that the output must
+	// match. If Expect is empty any output passes.
+	Test        string
+	Expect      string
+	TestTimeout int
+
+	expect *regexp.Regexp
+}
+
+// Provisioning steps of a board
+const (
+	provisioningNew      = ""
+	provisioningFlashed  = "flashed"
+	provisioningUploaded = "uploaded"
+	provisioningDone     = "done"
+)
+
+type ProvisioningStep struct {
+	Step    string    `json:"step"`
+	Ok      bool      `json:"ok"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type ProvisioningReport struct {
+	Job          string             `json:"job"`
+	Key          string             `json:"key"`
+	SerialNumber string             `json:"serialNumber"`
+	Mac          string             `json:"mac"`
+	Port         string             `json:"port"`
+	Commit       string             `json:"commit"`
+	Started      time.Time          `json:"started"`
+	Finished     time.Time          `json:"finished"`
+	Passed       bool               `json:"passed"`
+	Steps        []ProvisioningStep `json:"steps"`
+
+	state string
+}
+
+type provisioner struct {
+	mutex sync.Mutex
+
+	job     *ProvisioningJob
+	reports map[string]*ProvisioningReport
+
+	// Where progress is written, in headless mode
+	out io.Writer
+}
+
+var Provisioning = &provisioner{}
+
+func loadProvisioningJob(file string) (*ProvisioningJob, error) {
+	var job ProvisioningJob
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &job); err != nil {
+		return nil, err
+	}
+
+	if job.Name == "" {
+		job.Name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+	}
+
+	if job.Expect != "" {
+		if job.expect, err = regexp.Compile(job.Expect); err != nil {
+			return nil, err
+		}
+	}
+
+	if job.TestTimeout == 0 {
+		job.TestTimeout = provisioningTestTimeout
+	}
+
+	return &job, nil
+}
+
+// Check that the local folders of a job started by the IDE are inside the
+// project roots
+func (job *ProvisioningJob) checkLocalPaths() error {
+	for _, folder := range []string{job.Image, job.Files} {
+		if folder == "" {
+			continue
+		}
+
+		if err := checkLocalPath(folder); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *provisioner) start(job *ProvisioningJob) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.job = job
+	p.reports = make(map[string]*ProvisioningReport)
+
+	p.log("", "job "+job.Name+" started")
+	notify("provisioningStarted", jsonString("job")+": "+jsonString(job.Name))
+}
+
+func (p *provisioner) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.job != nil {
+		p.log("", "job "+p.job.Name+" stopped")
+		notify("provisioningStopped", jsonString("job")+": "+jsonString(p.job.Name))
+	}
+
+	p.job = nil
+}
+
+func (p *provisioner) currentJob() *ProvisioningJob {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.job
+}
+
+// Device rules of the current job, used for find boards when the IDE is not
+// attached
+func (p *provisioner) deviceRules() []DeviceRule {
+	job := p.currentJob()
+	if job == nil {
+		return nil
+	}
+
+	return job.Devices
+}
+
+func (p *provisioner) log(key string, message string) {
+	log.Println("provisioning", key, message)
+
+	if p.out != nil {
+		if key != "" {
+			fmt.Fprintf(p.out, "%s %s: %s\n", time.Now().Format("15:04:05"), key, message)
+		} else {
+			fmt.Fprintf(p.out, "%s %s\n", time.Now().Format("15:04:05"), message)
+		}
+	}
+}
+
+// A board has been attached
+func (p *provisioner) attached(board *Board, port *portInfo) {
+	job := p.currentJob()
+	if job == nil {
+		return
+	}
+
+	if len(job.Devices) > 0 && matchDeviceRule(job.Devices, port) == nil {
+		return
+	}
+
+	key := board.identityKey()
+	if key == "" {
+		key = "port:" + board.dev
+	}
+
+	p.mutex.Lock()
+	report, ok := p.findReport(key, board)
+	if !ok {
+		// New board, or a provisioned board that is plugged in again
+		report = &ProvisioningReport{
+			Job:          job.Name,
+			Key:          key,
+			SerialNumber: board.devInfo.USBSerialNumber(),
+			Port:         board.dev,
+			Started:      time.Now(),
+		}
+
+		p.reports[key] = report
+	}
+	p.mutex.Unlock()
+
+	BoardMutex.Lock()
+	defer BoardMutex.Unlock()
+
+	if connectedBoard != board {
+		return
+	}
+
+	var err error
+
+	switch report.state {
+	case provisioningNew:
+		if job.Firmware == "" && job.Image == "" {
+			report.state = provisioningFlashed
+			err = p.upload(job, board, report)
+		} else {
+			// The board is attached again when flashed
+			err = p.flash(job, board, report)
+		}
+
+	case provisioningFlashed:
+		err = p.upload(job, board, report)
+
+	case provisioningUploaded:
+		err = p.test(job, board, report)
+	}
+
+	if err != nil {
+		p.finish(report, board, err)
+	}
+}
+
+// Find the report of a board that is being provisioned. The MAC read by the
+// firmware can differ from the one read with esptool when flashing, so the board
+// is also found by its USB serial number, or by its port if it has none. Must
+// be called with the mutex locked.
+func (p *provisioner) findReport(key string, board *Board) (*ProvisioningReport, bool) {
+	if report, ok := p.reports[key]; ok && report.state != provisioningDone {
+		return report, true
+	}
+
+	serialNumber := board.devInfo.USBSerialNumber()
+
+	for _, report := range p.reports {
+		if report.state == provisioningDone {
+			continue
+		}
+
+		if serialNumber != "" && report.SerialNumber == serialNumber {
+			return report, true
+		}
+
+		if serialNumber == "" && report.SerialNumber == "" && report.Port == board.dev {
+			return report, true
+		}
+	}
+
+	return nil, false
+}
+
+// Change the key of a report
+func (p *provisioner) rekey(report *ProvisioningReport, key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if report.Key == key {
+		return
+	}
+
+	if p.reports[report.Key] == report {
+		delete(p.reports, report.Key)
+	}
+
+	p.log(report.Key, "key is now "+key)
+
+	report.Key = key
+	p.reports[key] = report
+}
+
+// Add a step to the report
+func (p *provisioner) step(report *ProvisioningReport, step string, err error, message string) {
+	if err != nil {
+		message = err.Error()
+	}
+
+	report.Steps = append(report.Steps, ProvisioningStep{
+		Step:    step,
+		Ok:      err == nil,
+		Message: message,
+		Time:    time.Now(),
+	})
+
+	p.log(report.Key, step+": "+message)
+
+	notify("provisioningUpdate", jsonString("key")+": "+jsonString(report.Key)+", "+jsonString("step")+": "+jsonString(step)+", "+jsonString("ok")+": "+fmt.Sprint(err == nil)+", "+jsonString("message")+": "+jsonString(message))
+}
+
+func (p *provisioner) flash(job *ProvisioningJob, board *Board, report *ProvisioningReport) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+
+		if err == nil {
+			report.state = provisioningFlashed
+		}
+
+		p.step(report, "flash", err, "firmware flashed")
+	}()
+
+	folder := job.Image
+	if job.Firmware != "" {
+		if err = downloadFirmware(job.Firmware); err != nil {
+			return err
+		}
+
+		folder = path.Join(AppDataTmpFolder, "firmware_files")
+	}
+
+	return board.withEsptool(func() error {
+		// A blank board has no MAC until flashed, so read it with esptool, and
+		// key the report on it, that is the key of the board once flashed
+		if err := board.esptool("read_mac"); err == nil && board.chip.Mac != "" {
+			report.Mac = board.chip.Mac
+			p.rekey(report, "mac:"+board.chip.Mac)
+		}
+
+		if err := board.flash(folder, "flash_args"); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(path.Join(folder, "flashfs_args")); err == nil && !(job.Files != "" && job.FilesystemImage) {
+			return board.flash(folder, "flashfs_args")
+		}
+
+		return nil
+	})
+}
+
+func (p *provisioner) upload(job *ProvisioningJob, board *Board, report *ProvisioningReport) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if !board.validFirmware || !board.validPrerequisites {
+		return errors.New("board is not running a valid firmware")
+	}
+
+	report.Commit = board.commit
+
+	// The MAC read with esptool when flashing is the base MAC, keep it
+	if report.Mac == "" {
+		report.Mac = board.chip.Mac
+	}
+
+	if job.Files != "" {
+		if job.FilesystemImage {
+			// The board is attached again when flashed
+			image := ""
+			if job.Firmware == "" {
+				image = job.Image
+			}
+
+			err = board.flashFilesystem(job.Files, image)
+			if err == nil {
+				report.state = provisioningUploaded
+			}
+
+			p.step(report, "upload", err, "filesystem image flashed")
+
+			return err
+		}
+
+		err = p.uploadFiles(job.Files, board)
+		p.step(report, "upload", err, "files uploaded")
+		if err != nil {
+			return err
+		}
+
+		// Boot with the uploaded files
+		board.reset(false)
+	}
+
+	report.state = provisioningUploaded
+
+	return p.test(job, board, report)
+}
+
+// Upload the files of a local folder to the board's root folder
+func (p *provisioner) uploadFiles(folder string, board *Board) error {
+	return filepath.Walk(folder, func(file string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(folder, file)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		dst := "/" + filepath.ToSlash(rel)
+
+		if finfo.IsDir() {
+			board.runCommand([]byte(luaCall("os.mkdir", dst)))
+			return nil
+		}
+
+		buffer, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Sending ", dst, " ...")
+
+		if board.uploadFile(dst, buffer) == "" {
+			return errors.New("can't write " + dst)
+		}
+
+		return nil
+	})
+}
+
+func (p *provisioner) test(job *ProvisioningJob, board *Board, report *ProvisioningReport) (err error) {
+	if job.Test == "" {
+		p.finish(report, board, nil)
+		return nil
+	}
+
+	output := ""
+
+	func() {
+		defer func() {
+			board.noTimeout()
+
+			if r := recover(); r != nil {
+				err = errors.New("self-test timeout")
+			}
+		}()
+
+		board.consoleOut = false
+		board.consoleIn = true
+		board.timeout(job.TestTimeout)
+		output = board.sendCommand(job.Test)
+		board.consume()
+		board.consoleOut = true
+		board.consoleIn = false
+	}()
+
+	if err == nil && job.expect != nil && !job.expect.MatchString(output) {
+		err = errors.New("unexpected self-test output: " + output)
+	}
+
+	p.step(report, "test", err, output)
+
+	if err != nil {
+		return err
+	}
+
+	p.finish(report, board, nil)
+
+	return nil
+}
+
+// Board provisioning is finished, write the report
+func (p *provisioner) finish(report *ProvisioningReport, board *Board, err error) {
+	report.state = provisioningDone
+	report.Finished = time.Now()
+	report.Passed = err == nil
+
+	if report.Mac == "" {
+		report.Mac = board.chip.Mac
+	}
+
+	folder := path.Join(AppDataFolder, "provisioning")
+	_ = os.Mkdir(folder, 0755)
+
+	file := path.Join(folder, reportNameRe.ReplaceAllString(report.Job, "_")+"-"+reportNameRe.ReplaceAllString(report.Key, "_")+"-"+report.Started.Format("20060102-150405")+".json")
+
+	b, _ := json.MarshalIndent(report, "", "\t")
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		log.Println("can't write provisioning report", err)
+	}
+
+	if report.Passed {
+		p.log(report.Key, "PASSED, replace the board")
+	} else {
+		p.log(report.Key, "FAILED, replace the board")
+	}
+
+	notify("provisioningDone", jsonString("key")+": "+jsonString(report.Key)+", "+jsonString("passed")+": "+fmt.Sprint(report.Passed)+", "+jsonString("report")+": "+jsonString(file))
+}
+
+// Run a provisioning job without the IDE
+func runProvisioning(job *ProvisioningJob, out io.Writer) {
+	startHeadless()
+
+	Provisioning.out = out
+	Provisioning.start(job)
+
+	monitor()
+}
@@ -0,0 +1,272 @@
+/*
+ * Whitecat Blocky Environment, board reset strategies
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/mikepb/go-serial"
+	"log"
+	"strings"
+	"time"
+)
+
+// A reset strategy resets a board using a specific method, depending on the
+// auto-reset circuit of the board
+type ResetStrategy interface {
+	// Strategy name, as used in device rules
+	Name() string
+
+	// State of the DTR / RTS lines when the serial port is opened
+	Lines() (dtr int, rts int)
+
+	// Reset the board
+	Reset(board *Board) error
+}
+
+// Default reset strategies, in the order that are tried
+var defaultResetMethods = []string{"rts", "dtr-rts", "soft"}
+
+// Get a reset strategy by name
+func resetStrategy(name string) ResetStrategy {
+	switch name {
+	case "rts":
+		return rtsReset{}
+	case "dtr-rts":
+		return dtrRtsReset{}
+	case "usb-jtag":
+		return usbJtagReset{}
+	case "none":
+		return noReset{}
+	case "soft":
+		return softReset{}
+	}
+
+	return nil
+}
+
+// Get the reset strategies for the board. Strategies can be set in the board's
+// device rule as a comma separated list. If the board is not ready after
+// a reset, the next strategy is used.
+func (board *Board) resetStrategies() []ResetStrategy {
+	var strategies []ResetStrategy
+
+	methods := defaultResetMethods
+	if board.resetMethod != "" {
+		methods = strings.Split(board.resetMethod, ",")
+	}
+
+	for _, method := range methods {
+		strategy := resetStrategy(strings.TrimSpace(method))
+		if strategy == nil {
+			log.Println("unknown reset method " + method)
+			continue
+		}
+
+		strategies = append(strategies, strategy)
+	}
+
+	if len(strategies) == 0 {
+		strategies = append(strategies, rtsReset{})
+	}
+
+	return strategies
+}
+
+// Set the DTR / RTS lines. Port is set to the baud rate used by the board when
+// booting.
+func (board *Board) setLines(dtr int, rts int) error {
+	options := serial.RawOptions
+	options.BitRate = bootBauds
+	options.Mode = serial.MODE_READ_WRITE
+	options.DTR = dtr
+	options.RTS = rts
+
+	return board.port.Apply(&options)
+}
+
+// Set a sequence of DTR / RTS line states, waiting delay after each one
+func (board *Board) lineSequence(delay time.Duration, states ...[2]int) error {
+	for _, state := range states {
+		if err := board.setLines(state[0], state[1]); err != nil {
+			return err
+		}
+
+		time.Sleep(delay)
+	}
+
+	return nil
+}
+
+// RTS is connected to EN, for boards with a single transistor auto-reset
+// circuit
+type rtsReset struct{}
+
+func (rtsReset) Name() string {
+	return "rts"
+}
+
+func (rtsReset) Lines() (int, int) {
+	return serial.DTR_OFF, serial.RTS_OFF
+}
+
+func (rtsReset) Reset(board *Board) error {
+	return board.lineSequence(time.Millisecond*10,
+		[2]int{serial.DTR_INVALID, serial.RTS_OFF},
+		[2]int{serial.DTR_INVALID, serial.RTS_ON},
+		[2]int{serial.DTR_INVALID, serial.RTS_OFF},
+	)
+}
+
+// Classic esptool auto-reset circuit, with DTR connected to IO0 and RTS
+// connected to EN. DTR is kept off so the board boots the application.
+type dtrRtsReset struct{}
+
+func (dtrRtsReset) Name() string {
+	return "dtr-rts"
+}
+
+func (dtrRtsReset) Lines() (int, int) {
+	return serial.DTR_OFF, serial.RTS_OFF
+}
+
+func (dtrRtsReset) Reset(board *Board) error {
+	return board.lineSequence(time.Millisecond*100,
+		[2]int{serial.DTR_OFF, serial.RTS_ON},
+		[2]int{serial.DTR_OFF, serial.RTS_OFF},
+	)
+}
+
+// Chips with an USB-JTAG-serial peripheral, where the lines are emulated and
+// need more time between states
+type usbJtagReset struct{}
+
+func (usbJtagReset) Name() string {
+	return "usb-jtag"
+}
+
+func (usbJtagReset) Lines() (int, int) {
+	return serial.DTR_OFF, serial.RTS_OFF
+}
+
+func (usbJtagReset) Reset(board *Board) error {
+	return board.lineSequence(time.Millisecond*200,
+		[2]int{serial.DTR_OFF, serial.RTS_OFF},
+		[2]int{serial.DTR_OFF, serial.RTS_ON},
+		[2]int{serial.DTR_OFF, serial.RTS_OFF},
+	)
+}
+
+// Boards without an auto-reset circuit. The user must press the reset button.
+type noReset struct{}
+
+func (noReset) Name() string {
+	return "none"
+}
+
+func (noReset) Lines() (int, int) {
+	return serial.DTR_INVALID, serial.RTS_INVALID
+}
+
+func (noReset) Reset(board *Board) error {
+	notify("boardUpdate", "Please, press the reset button of the board")
+
+	return nil
+}
+
+// Reset the board from Lua RTOS, interrupting the running program if any
+type softReset struct{}
+
+func (softReset) Name() string {
+	return "soft"
+}
+
+func (softReset) Lines() (int, int) {
+	return serial.DTR_OFF, serial.RTS_OFF
+}
+
+func (softReset) Reset(board *Board) error {
+	// Send Ctrl-C
+	if _, err := board.port.Write([]byte{3}); err != nil {
+		return err
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	if _, err := board.port.Write([]byte("\r\nos.exit()\r\n")); err != nil {
+		return err
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	return board.setLines(serial.DTR_INVALID, serial.RTS_INVALID)
+}
+
+// Reset the board with each reset strategy until the board is ready. Returns
+// false if the board has booted, but is not valid.
+func (board *Board) resetUntilReady() bool {
+	var err *bootError
+
+	for _, strategy := range board.resetStrategies() {
+		log.Println("reseting board using " + strategy.Name() + " method ...")
+
+		if err := strategy.Reset(board); err != nil {
+			log.Println("can't reset board", err)
+			continue
+		}
+
+		var ready bool
+
+		ready, err = board.waitForReady()
+		if err == nil {
+			return ready
+		}
+
+		log.Println("board is not ready after reset using "+strategy.Name()+" method", err)
+
+		if !err.retryable() {
+			break
+		}
+
+		board.consume()
+	}
+
+	if err == nil {
+		err = &bootError{Reason: bootNoBanner, State: bootResetting.String()}
+	}
+
+	notifyBootFailed(err)
+	panic(err)
+}
+
+func notifyBootFailed(err *bootError) {
+	info, _ := json.Marshal(err)
+
+	notify("boardBootFailed", string(info))
+}
@@ -0,0 +1,260 @@
+/*
+ * Whitecat Blocky Environment, inspector rules
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"regexp"
+)
+
+// A field of the notification sent when an inspector rule matches. The field
+// value is taken from a captured group of the rule's regular expression, or
+// from a constant value if Group is 0.
+type InspectorField struct {
+	Name   string
+	Group  int
+	Value  string
+	Base64 bool
+}
+
+// An inspector rule maps a line received from the board to a notification.
+type InspectorRule struct {
+	// Notification to send when the rule matches
+	Notification string
+
+	// Regular expression to match
+	Match string
+
+	// Notification fields
+	Fields []InspectorField
+
+	// If true the rule is only evaluated when board's boot events are notified
+	Boot bool
+
+	// If true the Lua RTOS prompt is removed from the line before matching
+	StripPrompt bool
+
+	// If true no more rules are evaluated for the line if rule matches
+	Final bool
+
+	re *regexp.Regexp
+}
+
+// An event found by the inspector
+type InspectorEvent struct {
+	Notification string
+
+	// Raw field values
+	Fields map[string]string
+
+	// Notification info, as expected by notify
+	Info string
+}
+
+// Built-in rules
+var builtinInspectorRules = []InspectorRule{
+	{
+		Notification: "boardPowerOnReset",
+		Match:        `^rst:.*\(POWERON_RESET\),boot:.*(.*)$`,
+		Boot:         true,
+	},
+	{
+		Notification: "boardSoftwareReset",
+		Match:        `^rst:.*(SW_CPU_RESET),boot:.*(.*)$`,
+		Boot:         true,
+	},
+	{
+		Notification: "boardDeepSleepReset",
+		Match:        `^rst:.*(DEEPSLEEP_RESET),boot.*(.*)$`,
+		Boot:         true,
+	},
+	{
+		Notification: "blockStart",
+		Match:        `\<blockStart,(.*)\>`,
+		Fields:       []InspectorField{{Name: "block", Group: 1, Base64: true}},
+		Boot:         true,
+	},
+	{
+		Notification: "blockEnd",
+		Match:        `\<blockEnd,(.*)\>`,
+		Fields:       []InspectorField{{Name: "block", Group: 1, Base64: true}},
+		Boot:         true,
+	},
+	{
+		Notification: "blockError",
+		Match:        `\<blockError,([0-9]*),(.*)\>`,
+		Fields: []InspectorField{
+			{Name: "block", Group: 1, Base64: true},
+			{Name: "error", Group: 2, Base64: true},
+		},
+		Boot: true,
+	},
+	{
+		Notification: "blockErrorCatched",
+		Match:        `\<blockErrorCatched,(.*)\>`,
+		Fields:       []InspectorField{{Name: "block", Group: 1, Base64: true}},
+		Boot:         true,
+	},
+	{
+		Notification: "boardRuntimeWarning",
+		Match:        `^([\/\.\/\-_a-zA-Z]*):(\d*)\:\s(\d*)\:(WARNING\s.*)$`,
+		Fields:       runtimeErrorFields,
+		StripPrompt:  true,
+		Final:        true,
+	},
+	{
+		Notification: "boardRuntimeError",
+		Match:        `^([\/\.\/\-_a-zA-Z]*):(\d*)\:\s(\d*)\:(.*)$`,
+		Fields:       runtimeErrorFields,
+		StripPrompt:  true,
+		Final:        true,
+	},
+	{
+		Notification: "boardRuntimeWarning",
+		Match:        `^([\/\.\/\-_a-zA-Z]*)\:(\d*)\:\s*(WARNING\s.*)$`,
+		Fields:       runtimeErrorNoExceptionFields,
+		StripPrompt:  true,
+		Final:        true,
+	},
+	{
+		Notification: "boardRuntimeError",
+		Match:        `^([\/\.\/\-_a-zA-Z]*)\:(\d*)\:\s*(.*)$`,
+		Fields:       runtimeErrorNoExceptionFields,
+		StripPrompt:  true,
+		Final:        true,
+	},
+}
+
+var runtimeErrorFields = []InspectorField{
+	{Name: "where", Group: 1},
+	{Name: "line", Group: 2},
+	{Name: "exception", Group: 3},
+	{Name: "message", Group: 4, Base64: true},
+}
+
+var runtimeErrorNoExceptionFields = []InspectorField{
+	{Name: "where", Group: 1},
+	{Name: "line", Group: 2},
+	{Name: "exception", Value: "0"},
+	{Name: "message", Group: 3, Base64: true},
+}
+
+var promptRe = regexp.MustCompile(`^/.*>\s`)
+
+// Get the inspector rules, user defined rules first. Rules with an invalid
+// regular expression are discarded.
+func inspectorRules() []*InspectorRule {
+	var rules []*InspectorRule
+
+	all := append(append([]InspectorRule{}, AgentConfig.InspectorRules...), builtinInspectorRules...)
+
+	for i := range all {
+		rule := all[i]
+
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			log.Println("invalid inspector rule for "+rule.Notification, err)
+			continue
+		}
+
+		rule.re = re
+		rules = append(rules, &rule)
+	}
+
+	return rules
+}
+
+// Test if rule matches line, and build the event
+func (rule *InspectorRule) match(line string) (*InspectorEvent, bool) {
+	if rule.StripPrompt {
+		line = promptRe.ReplaceAllString(line, "")
+	}
+
+	parts := rule.re.FindStringSubmatch(line)
+	if parts == nil {
+		return nil, false
+	}
+
+	event := &InspectorEvent{
+		Notification: rule.Notification,
+		Fields:       make(map[string]string),
+	}
+
+	for _, field := range rule.Fields {
+		value := field.Value
+		if field.Group > 0 && field.Group < len(parts) {
+			value = parts[field.Group]
+		}
+
+		event.Fields[field.Name] = value
+
+		if field.Base64 {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+
+		if event.Info != "" {
+			event.Info = event.Info + ", "
+		}
+
+		event.Info = event.Info + jsonString(field.Name) + ": " + jsonString(value)
+	}
+
+	return event, true
+}
+
+// Inspect a line received from the board, and return the found events
+func inspectLine(rules []*InspectorRule, line string, boot bool) []*InspectorEvent {
+	var events []*InspectorEvent
+
+	for _, rule := range rules {
+		if rule.Boot && !boot {
+			continue
+		}
+
+		if event, ok := rule.match(line); ok {
+			events = append(events, event)
+
+			if rule.Final {
+				break
+			}
+		}
+	}
+
+	return events
+}
+
+// Encode a string as a JSON string
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+
+	return string(b)
+}
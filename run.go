@@ -0,0 +1,230 @@
+/*
+ * Whitecat Blocky Environment, program runs
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Number of runs kept in history
+const runHistorySize = 50
+
+// Time to wait for the prompt when a program is interrupted
+const runStopTimeout = 2 * time.Second
+
+// Run status
+const (
+	runRunning  = "running"
+	runFinished = "finished"
+	runErrored  = "errored"
+	runStopped  = "stopped"
+)
+
+// The prompt, received without a new line
+var runPromptRe = regexp.MustCompile(`^/[^>]*> $`)
+
+// A program run
+type ProgramRun struct {
+	Id       int       `json:"id"`
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Run is being interrupted
+	stopping bool
+
+	// Closed when the run ends
+	done chan bool
+}
+
+// Tracks the programs run on a board
+type runTracker struct {
+	mutex sync.Mutex
+
+	nextId  int
+	current *ProgramRun
+	history []ProgramRun
+}
+
+func newRunTracker() *runTracker {
+	return &runTracker{nextId: 1}
+}
+
+func (run *ProgramRun) json() string {
+	b, _ := json.Marshal(run)
+
+	return string(b)
+}
+
+// A program is started
+func (tracker *runTracker) start(path string) *ProgramRun {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.end(runStopped, "")
+
+	run := &ProgramRun{
+		Id:      tracker.nextId,
+		Path:    path,
+		Status:  runRunning,
+		Started: time.Now(),
+		done:    make(chan bool),
+	}
+
+	tracker.nextId++
+	tracker.current = run
+
+	notify("boardRunStatus", run.json())
+
+	return run
+}
+
+// End the current run. Must be called with the mutex held.
+func (tracker *runTracker) end(status string, err string) {
+	run := tracker.current
+	if run == nil {
+		return
+	}
+
+	if run.stopping {
+		status = runStopped
+	}
+
+	run.Status = status
+	run.Finished = time.Now()
+
+	if run.Error == "" {
+		run.Error = err
+	}
+
+	tracker.current = nil
+
+	tracker.history = append(tracker.history, *run)
+	if len(tracker.history) > runHistorySize {
+		tracker.history = tracker.history[len(tracker.history)-runHistorySize:]
+	}
+
+	close(run.done)
+
+	notify("boardRunStatus", run.json())
+}
+
+// The prompt is received, so the program is finished
+func (tracker *runTracker) prompt() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.current == nil {
+		return
+	}
+
+	if tracker.current.Error != "" {
+		tracker.end(runErrored, "")
+	} else {
+		tracker.end(runFinished, "")
+	}
+}
+
+// A runtime error is received
+func (tracker *runTracker) error(message string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.current != nil && tracker.current.Error == "" {
+		tracker.current.Error = message
+	}
+}
+
+// The board is reset, so the program is stopped
+func (tracker *runTracker) reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.end(runStopped, "")
+}
+
+// The board reboots while the program is running
+func (tracker *runTracker) reboot(reason string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.end(runErrored, reason)
+}
+
+func (tracker *runTracker) running() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.current != nil
+}
+
+func (tracker *runTracker) getHistory() []ProgramRun {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	history := append([]ProgramRun{}, tracker.history...)
+	if tracker.current != nil {
+		history = append(history, *tracker.current)
+	}
+
+	return history
+}
+
+// Stop the running program. The program is interrupted with Ctrl-C, and if the
+// prompt is not received the board is reset. Returns true if the board is
+// reset.
+func (board *Board) stop() bool {
+	board.runs.mutex.Lock()
+	run := board.runs.current
+	if run != nil {
+		run.stopping = true
+	}
+	board.runs.mutex.Unlock()
+
+	if run != nil {
+		board.port.Write([]byte{0x03})
+
+		select {
+		case <-run.done:
+			return false
+		case <-time.After(runStopTimeout):
+		}
+	}
+
+	// Program is not running, but it can have threads running
+	board.reset(false)
+
+	return true
+}
@@ -0,0 +1,246 @@
+/*
+ * Whitecat Blocky Environment, board telemetry
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of telemetry samples kept in history
+const telemetryDefaultHistory = 360
+
+// Telemetry is not polled if the user has used the console recently
+const telemetryConsoleIdle = 5 * time.Second
+
+// Board side helper that prints a telemetry sample as a JSON object. Values not
+// available in the running firmware are null.
+const telemetryHelper = `
+_wcc_telemetry = function()
+	local function call(f, ...)
+		if type(f) ~= "function" then return nil end
+		local ok, v = pcall(f, ...)
+		if ok then return v end
+	end
+
+	local function num(v)
+		if type(v) ~= "number" then return "null" end
+		return string.format("%d", math.floor(v))
+	end
+
+	local function str(v)
+		if type(v) ~= "string" then return "null" end
+		return string.format("%q", v)
+	end
+
+	local tasks = call(thread and thread.list, true)
+	local ntasks = nil
+	if type(tasks) == "table" then
+		ntasks = 0
+		for _ in pairs(tasks) do ntasks = ntasks + 1 end
+	end
+
+	local fs = call(os.stats, "fs")
+	local fsUsed, fsTotal = nil, nil
+	if type(fs) == "table" then
+		fsUsed, fsTotal = fs.used, fs.total
+	end
+
+	print("{" ..
+		"\"heap\": " .. num(call(os.stats, "mem")) .. ", " ..
+		"\"luaMem\": " .. num(collectgarbage("count") * 1024) .. ", " ..
+		"\"uptime\": " .. num(call(os.clock)) .. ", " ..
+		"\"cpu\": " .. str(call(os.cpu)) .. ", " ..
+		"\"tasks\": " .. num(ntasks) .. ", " ..
+		"\"fsUsed\": " .. num(fsUsed) .. ", " ..
+		"\"fsTotal\": " .. num(fsTotal) ..
+	"}")
+end
+`
+
+// Polls the board for telemetry, and keeps the last samples
+type telemetryPoller struct {
+	mutex sync.Mutex
+
+	board *Board
+
+	// Poll interval, 0 if disabled
+	interval time.Duration
+
+	// Is the helper loaded on the board?
+	helperLoaded bool
+
+	history []map[string]interface{}
+	stop    chan bool
+}
+
+func newTelemetryPoller(board *Board) *telemetryPoller {
+	return &telemetryPoller{
+		board:    board,
+		interval: time.Duration(AgentConfig.Telemetry.Interval) * time.Millisecond,
+		stop:     make(chan bool),
+	}
+}
+
+// Set the poll interval, in milliseconds. 0 disables polling.
+func (poller *telemetryPoller) setInterval(ms int) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	poller.interval = time.Duration(ms) * time.Millisecond
+}
+
+// Board has been reset, so the helper must be loaded again
+func (poller *telemetryPoller) reset() {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	poller.helperLoaded = false
+}
+
+func (poller *telemetryPoller) getHistory() []map[string]interface{} {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	return append([]map[string]interface{}{}, poller.history...)
+}
+
+func (poller *telemetryPoller) run() {
+	log.Println("start telemetry ...")
+	defer log.Println("stop telemetry ...")
+
+	last := time.Now()
+
+	for {
+		select {
+		case <-poller.stop:
+			return
+		case <-time.After(time.Second):
+			poller.mutex.Lock()
+			interval := poller.interval
+			poller.mutex.Unlock()
+
+			if interval > 0 && time.Since(last) >= interval {
+				last = time.Now()
+				poller.poll()
+			}
+		}
+	}
+}
+
+// Take a telemetry sample, if the board is not in use
+func (poller *telemetryPoller) poll() {
+	board := poller.board
+
+	BoardMutex.Lock()
+	defer BoardMutex.Unlock()
+
+	if connectedBoard != board || Upgrading || board.info == "" {
+		return
+	}
+
+	if board.runs.running() || time.Since(board.lastConsoleIn) < telemetryConsoleIdle {
+		return
+	}
+
+	sample, err := poller.sample()
+	if err != nil {
+		log.Println("can't get telemetry", err)
+		return
+	}
+
+	sample["time"] = time.Now().UnixNano() / int64(time.Millisecond)
+
+	historySize := AgentConfig.Telemetry.History
+	if historySize <= 0 {
+		historySize = telemetryDefaultHistory
+	}
+
+	poller.mutex.Lock()
+	poller.history = append(poller.history, sample)
+	if len(poller.history) > historySize {
+		poller.history = poller.history[len(poller.history)-historySize:]
+	}
+	poller.mutex.Unlock()
+
+	info, err := json.Marshal(sample)
+	if err == nil {
+		notify("boardTelemetry", string(info))
+	}
+}
+
+// Ask the board for a telemetry sample
+func (poller *telemetryPoller) sample() (sample map[string]interface{}, err error) {
+	board := poller.board
+
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = errors.New("timeout")
+		}
+	}()
+
+	command := AgentConfig.Telemetry.Command
+	if command == "" {
+		poller.mutex.Lock()
+		helperLoaded := poller.helperLoaded
+		poller.mutex.Unlock()
+
+		if !helperLoaded {
+			board.runCode([]byte(telemetryHelper), nil)
+
+			poller.mutex.Lock()
+			poller.helperLoaded = true
+			poller.mutex.Unlock()
+		}
+
+		command = "_wcc_telemetry()"
+	}
+
+	board.consoleOut = false
+	board.consoleIn = true
+	board.timeout(2000)
+
+	response := board.sendCommand(command)
+
+	// The sample is the last line of the response
+	lines := strings.Split(strings.TrimSpace(response), "\n")
+
+	err = json.Unmarshal([]byte(strings.TrimSpace(lines[len(lines)-1])), &sample)
+
+	return sample, err
+}
@@ -0,0 +1,2 @@
+-- error: 2:5
+f() = 1
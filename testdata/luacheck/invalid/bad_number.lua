@@ -0,0 +1,2 @@
+-- error: 2:11
+local n = 3e
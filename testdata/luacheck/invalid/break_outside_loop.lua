@@ -0,0 +1,3 @@
+-- error: 3:1
+local x = 1
+break
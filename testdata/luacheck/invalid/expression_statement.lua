@@ -0,0 +1,2 @@
+-- error: 2:3
+x + 1
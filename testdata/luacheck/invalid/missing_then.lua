@@ -0,0 +1,4 @@
+-- error: 3:2
+if x == 1
+	print(x)
+end
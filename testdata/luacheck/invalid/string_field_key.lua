@@ -0,0 +1,2 @@
+-- error: 2:16
+local t = {"k" = 1}
@@ -0,0 +1,3 @@
+-- error: 4:1
+local function f()
+	print("x")
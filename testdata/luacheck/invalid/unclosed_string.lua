@@ -0,0 +1,3 @@
+-- error: 2:11
+local s = "not closed
+print(s)
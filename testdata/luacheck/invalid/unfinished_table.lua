@@ -0,0 +1,3 @@
+-- error: 3:1
+local t = {1, 2
+print(t)
@@ -0,0 +1,4 @@
+-- error: 3:9
+local function f(a)
+	return ...
+end
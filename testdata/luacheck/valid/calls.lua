@@ -0,0 +1,13 @@
+-- Calls with a table or a string as the argument
+local function f(x)
+	return x
+end
+
+f{}
+f{1, 2, n = 3, ["k"] = 4; 5}
+f""
+f"string"
+f[[long string]]
+f[==[long string]==]
+local t = f{f{}, f"=", f"," }
+print(f"x" .. f'y', t)
@@ -0,0 +1,22 @@
+-- Functions, methods and varargs
+local M = {}
+
+function M.new(...)
+	local self = setmetatable({args = {...}}, {__index = M})
+	return self
+end
+
+function M:count()
+	return #self.args
+end
+
+local function sum(...)
+	local s = 0
+	for _, v in ipairs({...}) do
+		s = s + v
+	end
+	return s
+end
+
+print(M.new(1, 2):count(), sum(1, 2, 3), select("#", ...))
+return M
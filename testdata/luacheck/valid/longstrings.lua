@@ -0,0 +1,13 @@
+-- Long strings and comments, with levels
+local a = [[
+line 1
+line 2]]
+local b = [==[
+contains ]] and ]=] but not the end
+]==]
+--[[ block
+comment ]]
+--[==[ block comment
+with ]] inside ]==]
+local c = #a + #b
+print(c)
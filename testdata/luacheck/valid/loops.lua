@@ -0,0 +1,22 @@
+-- break in nested loops
+while true do
+	for i = 1, 10 do
+		repeat
+			if i > 5 then
+				break
+			end
+		until true
+
+		if i == 3 then
+			break
+		end
+	end
+
+	break
+end
+
+for k, v in pairs({a = 1}) do
+	while v do
+		break
+	end
+end
@@ -0,0 +1,6 @@
+-- Method calls on literals
+local s = ("%d items"):format(3)
+local u = ("abc"):upper():lower()
+local l = #("xyz"):rep(2)
+local t = ({1, 2, 3})[2]
+print(s, u, l, t, ("x"):byte())
@@ -0,0 +1,7 @@
+-- Numeric forms
+local n = {
+	0x1p4, .5, 3e-2, 3E+2, 0xA, 0XfF, 1., 0x.8p1, 12, 3.14159,
+	0xA.8P-1, 1e10,
+}
+
+print(n[1] + n[2] - -n[3] * 2 ^ 2 // 1 % 3)
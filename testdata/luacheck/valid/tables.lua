@@ -0,0 +1,5 @@
+-- Table fields, a string "=" is not an assignment
+local t = {x = 1, "=", y = "=", ["="] = 2, z = {w = "="}}
+local a, b = t.x, t["="]
+t.x, t.y = b, a
+print(t, a, b)
@@ -0,0 +1,25 @@
+-- Blink a led, and report the temperature
+--[[
+  Long comments are removed too
+]]
+
+local led = pio.GPIO2   -- on board led
+
+local function report(temperature)
+    print(string.format(
+        "temperature: %.2f",
+        temperature
+    ))
+end
+
+    local banner = [[
+  Whitecat
+    sensor]] .. " v" .. 1.0
+
+thread.start(function()
+	while true do
+		pio.pin.inv(led) ; tmr.delayms(500)
+
+		report(sensor:read("temperature")) --[==[ inline ]==] report(-1)
+	end
+end)
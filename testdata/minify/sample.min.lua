@@ -0,0 +1,16 @@
+local led=pio.GPIO2
+local function report(temperature)
+print(string.format(
+"temperature: %.2f",
+temperature
+))
+end
+local banner=[[
+  Whitecat
+    sensor]].." v"..1.0
+thread.start(function()
+while true do
+pio.pin.inv(led);tmr.delayms(500)
+report(sensor:read("temperature"))report(-1)
+end
+end)
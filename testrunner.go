@@ -0,0 +1,422 @@
+/*
+ * Whitecat Blocky Environment, test runner
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+/*
+
+The test runner uploads a folder of Lua tests to the board, runs each test
+file, and reports the results as JUnit XML.
+
+Tests print their results using a TAP like protocol:
+
+1..3                    number of tests (optional)
+ok 1 - description      test passed
+not ok 2 - description  test failed
+ok 3 - description # SKIP reason
+# message               diagnostic, added to the previous test
+Bail out! reason        stop the test file
+
+A test file fails if it raises a runtime error, if it doesn't finish before the
+timeout, or if the number of tests doesn't match the plan.
+
+*/
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default timeout of a test file, in milliseconds
+const testDefaultTimeout = 30000
+
+// Folder in the board where tests are uploaded
+const testBoardFolder = "/test"
+
+var tapPlanRe = regexp.MustCompile(`^1\.\.(\d+)`)
+var tapResultRe = regexp.MustCompile(`^(not )?ok\b\s*(\d*)\s*(?:-\s*)?([^#]*)(?:#\s*(\w+)\s*(.*))?$`)
+var tapBailOutRe = regexp.MustCompile(`^Bail out!\s*(.*)$`)
+
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+type JUnitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+type JUnitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *JUnitFailure `xml:"failure,omitempty"`
+	Error     *JUnitFailure `xml:"error,omitempty"`
+	Skipped   *JUnitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type JUnitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []JUnitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type JUnitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []JUnitTestSuite `xml:"testsuite"`
+}
+
+// Add a test case to the suite, and update the counters
+func (suite *JUnitTestSuite) add(testCase JUnitTestCase) {
+	suite.Tests++
+
+	if testCase.Failure != nil {
+		suite.Failures++
+	}
+
+	if testCase.Error != nil {
+		suite.Errors++
+	}
+
+	if testCase.Skipped != nil {
+		suite.Skipped++
+	}
+
+	suite.TestCases = append(suite.TestCases, testCase)
+}
+
+func (suite *JUnitTestSuite) passed() bool {
+	return suite.Failures == 0 && suite.Errors == 0
+}
+
+// Parse the output of a test file
+func parseTestOutput(suite *JUnitTestSuite, rules []*InspectorRule, lines []string, finished bool, elapsed time.Duration) {
+	plan := -1
+	bailOut := ""
+	runtimeError := ""
+
+	var last *JUnitTestCase
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, " ")
+
+		for _, event := range inspectLine(rules, line, false) {
+			if event.Notification == "boardRuntimeError" && runtimeError == "" {
+				runtimeError = line
+			}
+		}
+
+		switch {
+		case tapPlanRe.MatchString(line):
+			plan, _ = strconv.Atoi(tapPlanRe.FindStringSubmatch(line)[1])
+
+		case tapResultRe.MatchString(line):
+			match := tapResultRe.FindStringSubmatch(line)
+
+			name := strings.TrimSpace(match[3])
+			if name == "" {
+				name = "test " + match[2]
+			}
+
+			testCase := JUnitTestCase{Name: name, ClassName: suite.Name}
+
+			directive := strings.ToUpper(match[4])
+
+			switch {
+			case directive == "SKIP":
+				testCase.Skipped = &JUnitSkipped{Message: strings.TrimSpace(match[5])}
+			case match[1] != "" && directive != "TODO":
+				testCase.Failure = &JUnitFailure{Message: line}
+			}
+
+			suite.add(testCase)
+			last = &suite.TestCases[len(suite.TestCases)-1]
+
+		case strings.HasPrefix(line, "#"):
+			if last != nil {
+				diagnostic := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+
+				if last.Failure != nil {
+					last.Failure.Text = last.Failure.Text + diagnostic + "\n"
+				} else {
+					last.SystemOut = last.SystemOut + diagnostic + "\n"
+				}
+			}
+
+		case tapBailOutRe.MatchString(line):
+			bailOut = tapBailOutRe.FindStringSubmatch(line)[1]
+		}
+
+		if bailOut != "" {
+			break
+		}
+	}
+
+	suite.Time = elapsed.Seconds()
+	suite.SystemOut = strings.Join(lines, "\n")
+
+	// Errors of the test file are reported as a test case
+	fileError := ""
+
+	switch {
+	case !finished:
+		fileError = "timeout"
+	case runtimeError != "":
+		fileError = runtimeError
+	case bailOut != "":
+		fileError = "bail out: " + bailOut
+	case plan >= 0 && plan != len(suite.TestCases):
+		fileError = fmt.Sprintf("planned %d tests, but %d tests run", plan, len(suite.TestCases))
+	case plan < 0 && len(suite.TestCases) == 0:
+		fileError = "no tests run"
+	}
+
+	if fileError != "" {
+		suite.add(JUnitTestCase{
+			Name:      path.Base(suite.Name),
+			ClassName: suite.Name,
+			Time:      suite.Time,
+			Error:     &JUnitFailure{Message: fileError, Text: suite.SystemOut},
+		})
+	}
+}
+
+// Get the test files of a folder. Test files are the Lua files named test*.lua
+// or *_test.lua, or all the Lua files of the folder if there are not files
+// named in this way.
+func testFiles(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var all, tests []string
+
+	for _, finfo := range files {
+		name := finfo.Name()
+		if finfo.IsDir() || !strings.HasSuffix(name, ".lua") {
+			continue
+		}
+
+		all = append(all, name)
+
+		if strings.HasPrefix(name, "test") || strings.HasSuffix(name, "_test.lua") {
+			tests = append(tests, name)
+		}
+	}
+
+	if len(tests) == 0 {
+		tests = all
+	}
+
+	sort.Strings(tests)
+
+	return tests, nil
+}
+
+// Run a command and get its output lines, until the prompt is received, or
+// until the deadline. Returns false if the deadline expires.
+func (board *Board) runUntil(command string, deadline time.Time) ([]string, bool) {
+	var lines []string
+
+	board.consume()
+	board.port.Write([]byte(command + "\r\n"))
+
+	echo := true
+
+	for {
+		line, ok := board.readLineUntil(deadline)
+		if !ok {
+			return lines, false
+		}
+
+		if echo && line == command {
+			echo = false
+			continue
+		}
+
+		if isPrompt(line) {
+			return lines, true
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+// Run f with the board locked, so the monitor and the telemetry don't use the
+// board meanwhile. Panics if the board has been detached.
+func (board *Board) locked(f func()) {
+	BoardMutex.Lock()
+	defer BoardMutex.Unlock()
+
+	if connectedBoard != board {
+		panic("board detached")
+	}
+
+	f()
+}
+
+// Upload the tests, and run each test file. The board is locked only while
+// uploading and while running each test file.
+func (board *Board) runTests(folder string, timeout time.Duration, progress func(suite *JUnitTestSuite)) (suites *JUnitTestSuites, err error) {
+	defer func() {
+		board.noTimeout()
+		board.consoleOut = true
+		board.consoleIn = false
+
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	tests, err := testFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tests) == 0 {
+		return nil, errors.New("no tests found in " + folder)
+	}
+
+	// Upload the test folder
+	board.locked(func() {
+		board.runCommand([]byte(luaCall("os.mkdir", testBoardFolder)))
+
+		err = filepath.Walk(folder, func(file string, finfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(folder, file)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			dst := testBoardFolder + "/" + filepath.ToSlash(rel)
+
+			if finfo.IsDir() {
+				board.runCommand([]byte(luaCall("os.mkdir", dst)))
+				return nil
+			}
+
+			buffer, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			if board.writeFile(dst, buffer) == "" {
+				return errors.New("can't upload " + dst)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	suites = &JUnitTestSuites{}
+
+	for _, test := range tests {
+		suite := JUnitTestSuite{
+			Name:      test,
+			Timestamp: time.Now().Format("2006-01-02T15:04:05"),
+		}
+
+		board.locked(func() {
+			board.consoleOut = false
+			board.consoleIn = true
+
+			board.port.Write([]byte("os.shell(false)\r\n"))
+			board.consume()
+
+			start := time.Now()
+			lines, finished := board.runUntil(luaCall("dofile", testBoardFolder+"/"+test), start.Add(timeout))
+
+			parseTestOutput(&suite, board.rules, lines, finished, time.Since(start))
+
+			// Stop the test
+			if !finished {
+				board.reset(false)
+			}
+		})
+
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Errors += suite.Errors
+		suites.Time += suite.Time
+
+		if progress != nil {
+			progress(&suite)
+		}
+	}
+
+	// Reenable shell
+	board.locked(func() {
+		if board.shell {
+			board.port.Write([]byte("os.shell(true)\r\n"))
+			board.consume()
+		}
+	})
+
+	return suites, nil
+}
+
+func (suites *JUnitTestSuites) write(file string) error {
+	b, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
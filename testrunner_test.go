@@ -0,0 +1,173 @@
+/*
+ * Whitecat Blocky Environment, test runner tests
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTestOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		finished bool
+		tests    int
+		failures int
+		errors   int
+		skipped  int
+		error    string
+	}{
+		{
+			name:     "passed",
+			output:   "1..2\nok 1 - first\nok 2 - second",
+			finished: true,
+			tests:    2,
+		},
+		{
+			name:     "failed",
+			output:   "1..2\nok 1 - first\nnot ok 2 - second\n# expected 1, got 2",
+			finished: true,
+			tests:    2,
+			failures: 1,
+		},
+		{
+			name:     "skip",
+			output:   "1..2\nok 1 - first # SKIP no wifi\nnot ok 2 - second # skip no wifi",
+			finished: true,
+			tests:    2,
+			skipped:  2,
+		},
+		{
+			name:     "todo",
+			output:   "1..2\nok 1 - first\nnot ok 2 - second # TODO not implemented",
+			finished: true,
+			tests:    2,
+		},
+		{
+			name:     "bail out",
+			output:   "1..3\nok 1 - first\nBail out! no sensor\nok 2 - second",
+			finished: true,
+			tests:    2,
+			errors:   1,
+			error:    "bail out: no sensor",
+		},
+		{
+			name:     "missing plan",
+			output:   "ok 1 - first\nok 2 - second",
+			finished: true,
+			tests:    2,
+		},
+		{
+			name:     "no tests",
+			output:   "hello",
+			finished: true,
+			tests:    1,
+			errors:   1,
+			error:    "no tests run",
+		},
+		{
+			name:     "plan mismatch",
+			output:   "1..3\nok 1 - first\nok 2 - second",
+			finished: true,
+			tests:    3,
+			errors:   1,
+			error:    "planned 3 tests, but 2 tests run",
+		},
+		{
+			name:     "runtime error",
+			output:   "1..2\nok 1 - first\n/test/test_a.lua:12: attempt to call a nil value (global 'foo')",
+			finished: true,
+			tests:    2,
+			errors:   1,
+			error:    "/test/test_a.lua:12: attempt to call a nil value (global 'foo')",
+		},
+		{
+			name:     "runtime error with exception",
+			output:   "1..1\n/test/test_a.lua:3: 2:i2c error",
+			finished: true,
+			tests:    1,
+			errors:   1,
+			error:    "/test/test_a.lua:3: 2:i2c error",
+		},
+		{
+			name:     "runtime warning",
+			output:   "1..1\n/test/test_a.lua:3: WARNING deprecated\nok 1",
+			finished: true,
+			tests:    1,
+		},
+		{
+			name:   "timeout",
+			output: "1..2\nok 1 - first",
+			tests:  2,
+			errors: 1,
+			error:  "timeout",
+		},
+	}
+
+	rules := inspectorRules()
+
+	for _, test := range tests {
+		suite := JUnitTestSuite{Name: "test/test_a.lua"}
+
+		parseTestOutput(&suite, rules, strings.Split(test.output, "\n"), test.finished, time.Second)
+
+		if suite.Tests != test.tests || suite.Failures != test.failures || suite.Errors != test.errors || suite.Skipped != test.skipped {
+			t.Errorf("%s: %d tests, %d failures, %d errors, %d skipped, expected %d, %d, %d, %d", test.name, suite.Tests, suite.Failures, suite.Errors, suite.Skipped, test.tests, test.failures, test.errors, test.skipped)
+			continue
+		}
+
+		if test.error != "" {
+			testCase := suite.TestCases[len(suite.TestCases)-1]
+			if testCase.Error == nil || testCase.Error.Message != test.error {
+				t.Errorf("%s: unexpected error %+v, expected %q", test.name, testCase.Error, test.error)
+			}
+		}
+	}
+}
+
+func TestParseTestOutputDiagnostics(t *testing.T) {
+	suite := JUnitTestSuite{Name: "test/test_a.lua"}
+
+	parseTestOutput(&suite, inspectorRules(), []string{"# before", "ok 1 - first", "# all right", "not ok 2", "# expected 1", "# got 2"}, true, time.Second)
+
+	if len(suite.TestCases) != 2 {
+		t.Fatalf("%d test cases, expected 2", len(suite.TestCases))
+	}
+
+	if suite.TestCases[0].Name != "first" || suite.TestCases[0].SystemOut != "all right\n" {
+		t.Errorf("unexpected test case %+v", suite.TestCases[0])
+	}
+
+	if suite.TestCases[1].Name != "test 2" || suite.TestCases[1].Failure == nil || suite.TestCases[1].Failure.Text != "expected 1\ngot 2\n" {
+		t.Errorf("unexpected test case %+v", suite.TestCases[1])
+	}
+}
@@ -0,0 +1,62 @@
+//+build linux
+
+/*
+ * Whitecat Blocky Environment, USB port information, linux
+ *
+ * Copyright (C) 2015 - 2016
+ * IBEROXARXA SERVICIOS INTEGRALES, S.L.
+ *
+ * Author: Jaume Olivé (jolive@iberoxarxa.com / jolive@whitecatboard.org)
+ *
+ * All rights reserved.
+ *
+ * Permission to use, copy, modify, and distribute this software
+ * and its documentation for any purpose and without fee is hereby
+ * granted, provided that the above copyright notice appear in all
+ * copies and that both that the copyright notice and this
+ * permission notice and warranty disclaimer appear in supporting
+ * documentation, and that the name of the author not be used in
+ * advertising or publicity pertaining to distribution of the
+ * software without specific, written prior permission.
+ *
+ * The author disclaim all warranties with regard to this
+ * software, including all implied warranties of merchantability
+ * and fitness.  In no event shall the author be liable for any
+ * special, indirect or consequential damages or any damages
+ * whatsoever resulting from loss of use, data or profits, whether
+ * in an action of contract, negligence or other tortious action,
+ * arising out of or in connection with the use or performance of
+ * this software.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Get the USB interface number of a serial port from sysfs
+func usbInterfaceNumber(name string) (int, bool) {
+	device, err := filepath.EvalSymlinks(path.Join("/sys/class/tty", path.Base(name), "device"))
+	if err != nil {
+		return 0, false
+	}
+
+	// ttyACM devices are the interface, ttyUSB devices are a child of the
+	// interface
+	for _, dir := range []string{device, path.Dir(device)} {
+		b, err := ioutil.ReadFile(path.Join(dir, "bInterfaceNumber"))
+		if err == nil {
+			iface, err := strconv.ParseInt(strings.TrimSpace(string(b)), 16, 32)
+			if err == nil {
+				return int(iface), true
+			}
+		}
+	}
+
+	return 0, false
+}
@@ -39,17 +39,52 @@ functions:
 
 Notifications:
 
-{"notify": "boardAttached", "info": {"modules":[], "maps": []}}
+{"notify": "boardAttached", "info": {"info": {"modules":[], "maps": []}, "newBuild": false, "bauds": 115200, "chip": {"chip": "xx", "revision": "xx", "crystal": "xx", "mac": "xx", "flashSize": "xx"}, "inventory": {"key": "xx", "name": "xx", ...}}}
+{"notify": "boardInfo", "info": {"info": {"modules":[], "maps": []}, "newBuild": false, "bauds": 115200, "chip": {...}, "inventory": {...}}}
 {"notify": "boardDetached", "info": {}}
 {"notify": "boardPowerOnReset", "info": {}}
 {"notify": "boardSoftwareReset", "info": {}}
 {"notify": "boardDeepSleepReset", "info": {}}
-{"notify": "boardRuntimeError", "info": {"where": "xx", "line": "xx", "exception": "xx", "message": "xx"}}
+{"notify": "boardRemoveFile", "info": {"path": "xx", "ok": true, "error": "xx"}}
+{"notify": "boardMkdir", "info": {"path": "xx", "ok": true, "error": "xx"}}
+{"notify": "boardRemoveDir", "info": {"path": "xx", "ok": true, "error": "xx"}}
+{"notify": "boardRename", "info": {"path": "xx", "ok": true, "error": "xx"}}
+{"notify": "boardCopy", "info": {"path": "xx", "ok": true, "error": "xx"}}
+{"notify": "boardStat", "info": {"path": "xx", "ok": true, "error": "xx", "stat": {"path": "xx", "type": "file | directory", "size": 0, "mtime": 0}}}
+{"notify": "boardDiskUsage", "info": {"path": "xx", "ok": true, "error": "xx", "usage": {"path": "xx", "files": 0, "directories": 0, "size": 0, "used": 0, "total": 0}}}
+{"notify": "boardEvaluate", "info": {"ok": true, "values": [{"type": "xx", "value": ...}], "stdout": "xx", "error": "xx", "traceback": "xx", "timeout": false, "reset": false, "elapsedMs": 0}}
+{"notify": "boardSyntaxError", "info": {"path": "xx", "line": 0, "col": 0, "message": "xx"}}
+{"notify": "boardLuaWarnings", "info": {"path": "xx", "warnings": [{"line": 0, "col": 0, "name": "xx", "message": "xx"}]}}
+{"notify": "boardRuntimeError", "info": {"where": "xx", "line": "xx", "exception": "xx", "message": "xx", "context": [{"line": 0, "code": "xx"}], "traceback": [{"where": "xx", "line": "xx", "what": "xx"}], "block": "xx", "blocks": ["xx"]}}
+{"notify": "boardPanic", "info": {"core": 0, "cause": "xx", "pc": {}, "registers": {}, "frames": [{"address": "xx", "sp": "xx", "function": "xx", "file": "xx", "line": 0}], "dump": "xx"}}
 {"notify": "boardConsoleOut", "info": {"content": "xxx"}}
+{"notify": "boardProfile", "info": {"started": "xx", "elapsedMs": 0, "blocks": [{"block": "xx", "count": 0, "errors": 0, "totalMs": 0, "minMs": 0, "maxMs": 0, "meanMs": 0}], "active": [{"block": "xx", "elapsedMs": 0}], "truncated": false}}
+{"notify": "boardTrace", "info": {"traceEvents": [], "displayTimeUnit": "ms"}}
+{"notify": "boardTraceExported", "info": {"path": "xxxx"}}
+{"notify": "boardTelemetry", "info": {"time": 0, "heap": 0, "luaMem": 0, "uptime": 0, "cpu": "xx", "tasks": 0, "fsUsed": 0, "fsTotal": 0}}
+{"notify": "boardTelemetryHistory", "info": [{"time": 0, "heap": 0, ...}]}
+{"notify": "boardRunProgram", "info": {"id": 0}}
+{"notify": "boardRunProject", "info": {"id": 0}}
+{"notify": "boardAutorunRestored", "info": {}}
+{"notify": "boardRunStatus", "info": {"id": 0, "path": "xx", "status": "running | finished | errored | stopped", "error": "xx", "started": "xx", "finished": "xx"}}
+{"notify": "boardRuns", "info": [{"id": 0, "path": "xx", "status": "xx", ...}]}
+{"notify": "boardPartitions", "info": {"source": "xx", "partitions": [{"label": "xx", "type": "xx", "subType": "xx", "offset": 0, "size": 0, "encrypted": false}]}}
+{"notify": "boardPartitionTableFlashed", "info": {}}
+{"notify": "boardPartitionFlashed", "info": {"label": "xx"}}
+{"notify": "boardFilesystemFlashed", "info": {}}
+{"notify": "provisioningStarted", "info": {"job": "xx"}}
+{"notify": "provisioningStopped", "info": {"job": "xx"}}
+{"notify": "provisioningUpdate", "info": {"key": "xx", "step": "xx", "ok": true, "message": "xx"}}
+{"notify": "provisioningDone", "info": {"key": "xx", "passed": true, "report": "xx"}}
+{"notify": "inventoryList", "info": [{"key": "xx", "serialNumber": "xx", "mac": "xx", "model": "xx", "brand": "xx", "subtype": "xx", "build": "xx", "commit": "xx", "port": "xx", "firstSeen": "xx", "lastSeen": "xx", "name": "xx", "notes": "xx"}]}
+{"notify": "inventoryUpdated", "info": {"key": "xx", ...}}
+{"notify": "inventoryRemoved", "info": {"key": "xx"}}
+{"notify": "inventoryError", "info": {"message": "xx"}}
 {"notify": "boardUptate", "info": {}}
 {"notify": "boardUpgraded", "info": {}}
 {"notify": "boardTimeout", "info": {}}
 {"notify": "invalidFirmware", "info": {}}
+{"notify": "boardBootFailed", "info": {"reason": "xx", "state": "xx", "log": "xx"}}
 
 Available commands:
 
@@ -62,9 +97,34 @@ Available commands:
 {"command": "boardStop, "arguments": "{}"}
 {"command": "boardGetDirContent", "arguments": {"path": "xxxx"}}
 {"command": "boardReadFile", "arguments": {"path": "xxxx"}}
-{"command": "boardRunProgram", "arguments": {"path": "xxxx", "code": "xxxx"}}
+{"command": "boardRemoveFile", "arguments": {"path": "base64"}}
+{"command": "boardMkdir", "arguments": {"path": "base64"}}
+{"command": "boardRemoveDir", "arguments": {"path": "base64"}}
+{"command": "boardRename", "arguments": {"path": "base64", "to": "base64"}}
+{"command": "boardCopy", "arguments": {"path": "base64", "to": "base64"}}
+{"command": "boardStat", "arguments": {"path": "base64"}}
+{"command": "boardDiskUsage", "arguments": {"path": "base64"}}
+{"command": "boardRunProgram", "arguments": {"path": "xxxx", "code": "xxxx", "mode": "autorun | file | ephemeral"}}
+{"command": "boardRunProject", "arguments": {"path": "xxxx", "folder": "xxxx", "mode": "autorun | file | ephemeral"}}
+{"command": "boardRestoreAutorun", "arguments": "{}"}
 {"command": "boardRunCommand", "arguments": {"code": "xxxx"}}
+{"command": "boardEvaluate", "arguments": {"code": "xxxx", "timeout": 10000}}
 {"command": "boardInstall", "arguments": {"firmware": "xxxx"}}
+{"command": "boardGetProfile", "arguments": "{}"}
+{"command": "boardGetTrace", "arguments": "{}"}
+{"command": "boardExportTrace", "arguments": {}}
+{"command": "boardTelemetry", "arguments": {"interval": 0}}
+{"command": "boardGetTelemetry", "arguments": "{}"}
+{"command": "boardGetRuns", "arguments": "{}"}
+{"command": "boardGetPartitions", "arguments": {"source": "firmware | board"}}
+{"command": "boardFlashPartitionTable", "arguments": {"path": "xxxx"}}
+{"command": "boardFlashPartition", "arguments": {"label": "xxxx", "path": "xxxx"}}
+{"command": "boardFlashFilesystem", "arguments": {"path": "xxxx"}}
+{"command": "provisioningStart", "arguments": {"path": "xxxx"}}
+{"command": "provisioningStop", "arguments": "{}"}
+{"command": "inventoryList", "arguments": "{}"}
+{"command": "inventoryUpdate", "arguments": {"key": "xxxx", "name": "xxxx", "notes": "xxxx"}}
+{"command": "inventoryRemove", "arguments": {"key": "xxxx"}}
 
 */
 
@@ -72,9 +132,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"golang.org/x/net/websocket"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -107,11 +170,29 @@ type CommandFileSystem struct {
 	}
 }
 
+type CommandFsOperation struct {
+	Command   string
+	Arguments struct {
+		Path string
+		To   string
+	}
+}
+
 type CommandRunProgram struct {
 	Command   string
 	Arguments struct {
 		Path string
 		Code string
+		Mode string
+	}
+}
+
+type CommandRunProject struct {
+	Command   string
+	Arguments struct {
+		Path   string
+		Folder string
+		Mode   string
 	}
 }
 
@@ -123,6 +204,39 @@ type CommandRunCommand struct {
 	}
 }
 
+type CommandEvaluate struct {
+	Command   string
+	Arguments struct {
+		Code    string
+		Timeout int
+	}
+}
+
+type CommandTelemetry struct {
+	Command   string
+	Arguments struct {
+		Interval int
+	}
+}
+
+type CommandPartitions struct {
+	Command   string
+	Arguments struct {
+		Source string
+		Label  string
+		Path   string
+	}
+}
+
+type CommandInventory struct {
+	Command   string
+	Arguments struct {
+		Key   string
+		Name  string
+		Notes string
+	}
+}
+
 type CommandInstallCommand struct {
 	Command   string
 	Arguments struct {
@@ -137,6 +251,24 @@ type AttachIdeCommand struct {
 	}
 }
 
+// Get the information of the board sent to the IDE
+func (board *Board) attachedInfo() string {
+	newBuild := "false"
+	if board.newBuild {
+		newBuild = "true"
+	}
+
+	inventory := "null"
+	if entry, ok := Inventory.get(board.inventoryKey); ok {
+		b, _ := json.Marshal(entry)
+		inventory = string(b)
+	}
+
+	chip, _ := json.Marshal(board.chip)
+
+	return "{\"info\": " + board.info + ", \"newBuild\": " + newBuild + ", \"bauds\": " + strconv.Itoa(board.bauds) + ", \"chip\": " + string(chip) + ", \"inventory\": " + inventory + "}"
+}
+
 func notify(notification string, data string) {
 	var err error
 	var msg string
@@ -145,12 +277,10 @@ func notify(notification string, data string) {
 	// Build info for each notification type
 	switch notification {
 	case "boardAttached":
-		newBuild := "false"
-		if connectedBoard.newBuild {
-			newBuild = "true"
-		}
+		info = connectedBoard.attachedInfo()
 
-		info = "{\"info\": " + connectedBoard.info + ", \"newBuild\": " + newBuild + "}"
+	case "boardInfo":
+		info = connectedBoard.attachedInfo()
 
 	case "blockStart":
 		info = "{" + data + "}"
@@ -167,6 +297,48 @@ func notify(notification string, data string) {
 	case "boardRuntimeWarning":
 		info = "{" + data + "}"
 
+	case "boardPanic":
+		info = data
+
+	case "boardBootFailed":
+		info = data
+
+	case "boardProfile":
+		info = data
+
+	case "boardTrace":
+		info = data
+
+	case "boardTelemetry":
+		info = data
+
+	case "boardTelemetryHistory":
+		info = data
+
+	case "boardPartitions":
+		info = data
+
+	case "boardRunStatus":
+		info = data
+
+	case "boardRuns":
+		info = data
+
+	case "boardSyntaxError":
+		info = data
+
+	case "boardEvaluate":
+		info = data
+
+	case "boardLuaWarnings":
+		info = data
+
+	case "inventoryList":
+		info = data
+
+	case "inventoryUpdated":
+		info = data
+
 	case "boardGetDirContent":
 		info = data
 
@@ -184,6 +356,12 @@ func notify(notification string, data string) {
 
 	case "attachIde":
 		info = "{\"agent-version\": \"" + Version + "\"}"
+
+	default:
+		// Notifications sent by user defined inspector rules
+		if data != "" {
+			info = "{" + data + "}"
+		}
 	}
 
 	// Build message
@@ -203,12 +381,23 @@ func control(ws *websocket.Conn) {
 	var msg string
 	var err error
 	var command Command
+	var locked bool
 
 	ControlWs = ws
 
 	log.Println("start control ...")
 
 	defer func() {
+		// A command can be interrupted, if the board is detached while
+		// processing it
+		if r := recover(); r != nil {
+			log.Println("command interrupted:", r)
+		}
+
+		if locked {
+			BoardMutex.Unlock()
+		}
+
 		ws.Close()
 		log.Println("stop control ...")
 	}()
@@ -234,6 +423,23 @@ func control(ws *websocket.Conn) {
 		// Parse command
 		json.Unmarshal([]byte(msg), &command)
 
+		if command.Command == "detachIde" {
+			// Monitor can be waiting for the board, so don't lock it until
+			// monitor is stopped
+			IdeDetach <- true
+			IdeDetach <- true
+
+			BoardMutex.Lock()
+			connectedBoard.detach()
+			BoardMutex.Unlock()
+
+			return
+		}
+
+		// Board can't be used by anyone else while processing the command
+		BoardMutex.Lock()
+		locked = true
+
 		switch command.Command {
 		case "attachIde":
 			if connectedBoard == nil {
@@ -251,13 +457,6 @@ func control(ws *websocket.Conn) {
 				notify("boardAttached", "")
 			}
 
-		case "detachIde":
-			IdeDetach <- true
-			IdeDetach <- true
-			connectedBoard.detach()
-
-			return
-
 		case "boardReset":
 			if connectedBoard != nil {
 				notify("boardUpdate", "Reseting board")
@@ -269,9 +468,10 @@ func control(ws *websocket.Conn) {
 		case "boardStop":
 			if connectedBoard != nil {
 				notify("boardUpdate", "Stopping program")
-				connectedBoard.reset(false)
-				notify("boardReset", "")
-				notify("boardAttached", "")
+				if connectedBoard.stop() {
+					notify("boardReset", "")
+					notify("boardAttached", "")
+				}
 			}
 
 		case "boardGetDirContent":
@@ -343,8 +543,15 @@ func control(ws *websocket.Conn) {
 				json.Unmarshal([]byte(msg), &fsCommand)
 
 				content, err := base64.StdEncoding.DecodeString(fsCommand.Arguments.Content)
+				if err == nil && strings.HasSuffix(fsCommand.Arguments.Path, ".lua") {
+					if connectedBoard.checkLua(fsCommand.Arguments.Path, content) != nil {
+						notify("boardWriteFile", "")
+						break
+					}
+				}
+
 				if err == nil {
-					ret := connectedBoard.writeFile(fsCommand.Arguments.Path, content)
+					ret := connectedBoard.uploadFile(fsCommand.Arguments.Path, content)
 					if ret == "" {
 						// writeFile has failed, probably because the main thread is executing
 						// a blocking program.
@@ -356,7 +563,7 @@ func control(ws *websocket.Conn) {
 						notify("boardReset", "")
 						notify("boardAttached", "")
 
-						ret = connectedBoard.writeFile(fsCommand.Arguments.Path, content)
+						ret = connectedBoard.uploadFile(fsCommand.Arguments.Path, content)
 						if ret == "" {
 							// Ooops, something is wrong
 							notify("boardWriteFile", "")
@@ -378,8 +585,52 @@ func control(ws *websocket.Conn) {
 
 				path, err := base64.StdEncoding.DecodeString(fsCommand.Arguments.Path)
 				if err == nil {
-					connectedBoard.removeFile(string(path))
-					notify("boardRemoveFile", "")
+					err = connectedBoard.removeFile(string(path))
+					notify("boardRemoveFile", fsNotification(string(path), err, "", nil))
+				}
+			}
+
+		case "boardMkdir", "boardRemoveDir", "boardRename", "boardCopy", "boardStat", "boardDiskUsage":
+			if connectedBoard != nil {
+				var fsCommand CommandFsOperation
+
+				json.Unmarshal([]byte(msg), &fsCommand)
+
+				// Paths are base64 encoded, as in boardRemoveFile
+				fromBytes, err := base64.StdEncoding.DecodeString(fsCommand.Arguments.Path)
+				if err != nil {
+					notify(command.Command, fsNotification(fsCommand.Arguments.Path, err, "", nil))
+					break
+				}
+
+				toBytes, err := base64.StdEncoding.DecodeString(fsCommand.Arguments.To)
+				if err != nil {
+					notify(command.Command, fsNotification(string(fromBytes), err, "", nil))
+					break
+				}
+
+				from, to := string(fromBytes), string(toBytes)
+
+				switch command.Command {
+				case "boardMkdir":
+					notify(command.Command, fsNotification(from, connectedBoard.mkdir(from), "", nil))
+
+				case "boardRemoveDir":
+					notify(command.Command, fsNotification(from, connectedBoard.removeAll(from), "", nil))
+
+				case "boardRename":
+					notify(command.Command, fsNotification(from, connectedBoard.rename(from, to), "", nil))
+
+				case "boardCopy":
+					notify(command.Command, fsNotification(from, connectedBoard.copy(from, to), "", nil))
+
+				case "boardStat":
+					stat, err := connectedBoard.stat(from)
+					notify(command.Command, fsNotification(from, err, "stat", stat))
+
+				case "boardDiskUsage":
+					usage, err := connectedBoard.diskUsage(from)
+					notify(command.Command, fsNotification(from, err, "usage", usage))
 				}
 			}
 
@@ -391,8 +642,12 @@ func control(ws *websocket.Conn) {
 
 				code, err := base64.StdEncoding.DecodeString(runCommand.Arguments.Code)
 				if err == nil {
-					connectedBoard.runProgram(runCommand.Arguments.Path, []byte(code))
-					notify("boardRunProgram", "")
+					id, err := connectedBoard.runProgram(runCommand.Arguments.Path, []byte(code), runCommand.Arguments.Mode)
+					if err != nil {
+						notify("boardUpdate", err.Error())
+					}
+
+					notify("boardRunProgram", jsonString("id")+": "+strconv.Itoa(id))
 				}
 			}
 
@@ -404,12 +659,270 @@ func control(ws *websocket.Conn) {
 
 				code, err := base64.StdEncoding.DecodeString(runCommand.Arguments.Code)
 				if err == nil {
-					connectedBoard.runCode(code)
+					if err = connectedBoard.checkLua("stdin", code); err != nil {
+						notify("boardRunCommand", base64.StdEncoding.EncodeToString([]byte(err.Error())))
+						break
+					}
+
+					connectedBoard.runCode(code, nil)
 					response := connectedBoard.runCommand([]byte("_code()"))
 					notify("boardRunCommand", base64.StdEncoding.EncodeToString([]byte(response)))
 				}
 			}
 
+		case "boardEvaluate":
+			if connectedBoard != nil {
+				var evalCommand CommandEvaluate
+
+				json.Unmarshal([]byte(msg), &evalCommand)
+
+				code, err := base64.StdEncoding.DecodeString(evalCommand.Arguments.Code)
+				if err == nil {
+					result := connectedBoard.evaluate(code, time.Duration(evalCommand.Arguments.Timeout)*time.Millisecond)
+
+					info, err := json.Marshal(result)
+					if err == nil {
+						notify("boardEvaluate", string(info))
+					}
+
+					if result.Reset {
+						notify("boardReset", "")
+						notify("boardAttached", "")
+					}
+				}
+			}
+
+		case "boardGetProfile":
+			if connectedBoard != nil {
+				report, err := json.Marshal(connectedBoard.profiler.report())
+				if err == nil {
+					notify("boardProfile", string(report))
+				}
+			}
+
+		case "boardGetTrace":
+			if connectedBoard != nil {
+				trace, err := connectedBoard.profiler.chromeTrace()
+				if err == nil {
+					notify("boardTrace", string(trace))
+				}
+			}
+
+		case "boardExportTrace":
+			if connectedBoard != nil {
+				// The agent chooses the file, the IDE can't write outside the traces
+				// folder
+				_ = os.Mkdir(path.Join(AppDataFolder, "traces"), 0755)
+				file := path.Join(AppDataFolder, "traces", "trace-"+time.Now().Format("20060102-150405.000")+".json")
+
+				trace, err := connectedBoard.profiler.chromeTrace()
+				if err == nil {
+					err = ioutil.WriteFile(file, trace, 0644)
+				}
+
+				if err == nil {
+					notify("boardTraceExported", jsonString("path")+": "+jsonString(file))
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardTelemetry":
+			if connectedBoard != nil {
+				var telemetryCommand CommandTelemetry
+
+				json.Unmarshal([]byte(msg), &telemetryCommand)
+
+				connectedBoard.telemetry.setInterval(telemetryCommand.Arguments.Interval)
+			}
+
+		case "boardGetTelemetry":
+			if connectedBoard != nil {
+				history, err := json.Marshal(connectedBoard.telemetry.getHistory())
+				if err == nil {
+					notify("boardTelemetryHistory", string(history))
+				}
+			}
+
+		case "boardInfo":
+			if connectedBoard != nil {
+				notify("boardInfo", "")
+			}
+
+		case "boardRunProject":
+			if connectedBoard != nil {
+				var runCommand CommandRunProject
+
+				json.Unmarshal([]byte(msg), &runCommand)
+
+				var id int
+
+				err := checkLocalPath(runCommand.Arguments.Path)
+				if err == nil {
+					id, err = connectedBoard.runProject(runCommand.Arguments.Path, runCommand.Arguments.Folder, runCommand.Arguments.Mode)
+				}
+
+				if err == nil {
+					notify("boardRunProject", jsonString("id")+": "+strconv.Itoa(id))
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardRestoreAutorun":
+			if connectedBoard != nil {
+				if err := connectedBoard.restoreAutorun(); err == nil {
+					notify("boardAutorunRestored", "")
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardGetRuns":
+			if connectedBoard != nil {
+				runs, err := json.Marshal(connectedBoard.runs.getHistory())
+				if err == nil {
+					notify("boardRuns", string(runs))
+				}
+			}
+
+		case "boardGetPartitions":
+			if connectedBoard != nil {
+				var partitionsCommand CommandPartitions
+				var partitions []Partition
+				var err error
+
+				json.Unmarshal([]byte(msg), &partitionsCommand)
+
+				source := partitionsCommand.Arguments.Source
+				if source == "board" {
+					partitions, err = connectedBoard.getPartitions()
+				} else {
+					source = "firmware"
+
+					err = downloadFirmware(connectedBoard.firmware)
+					if err == nil {
+						partitions, err = firmwarePartitionTable(path.Join(AppDataTmpFolder, "firmware_files"))
+					}
+				}
+
+				if err == nil {
+					b, _ := json.Marshal(partitions)
+					notify("boardPartitions", "{"+jsonString("source")+": "+jsonString(source)+", "+jsonString("partitions")+": "+string(b)+"}")
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardFlashPartitionTable":
+			if connectedBoard != nil {
+				var partitionsCommand CommandPartitions
+
+				json.Unmarshal([]byte(msg), &partitionsCommand)
+
+				err := checkLocalPath(partitionsCommand.Arguments.Path)
+				if err == nil {
+					err = connectedBoard.flashPartitionTable(partitionsCommand.Arguments.Path)
+				}
+
+				if err == nil {
+					notify("boardPartitionTableFlashed", "")
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardFlashPartition":
+			if connectedBoard != nil {
+				var partitionsCommand CommandPartitions
+
+				json.Unmarshal([]byte(msg), &partitionsCommand)
+
+				err := checkLocalPath(partitionsCommand.Arguments.Path)
+				if err == nil {
+					err = connectedBoard.flashPartition(partitionsCommand.Arguments.Label, partitionsCommand.Arguments.Path)
+				}
+
+				if err == nil {
+					notify("boardPartitionFlashed", jsonString("label")+": "+jsonString(partitionsCommand.Arguments.Label))
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "boardFlashFilesystem":
+			if connectedBoard != nil {
+				var fsCommand CommandFileSystem
+
+				json.Unmarshal([]byte(msg), &fsCommand)
+
+				err := checkLocalPath(fsCommand.Arguments.Path)
+				if err == nil {
+					err = connectedBoard.flashFilesystem(fsCommand.Arguments.Path, "")
+				}
+
+				if err == nil {
+					notify("boardFilesystemFlashed", "")
+				} else {
+					notify("boardUpdate", err.Error())
+				}
+			}
+
+		case "provisioningStart":
+			var fsCommand CommandFileSystem
+
+			json.Unmarshal([]byte(msg), &fsCommand)
+
+			var job *ProvisioningJob
+
+			err := checkLocalPath(fsCommand.Arguments.Path)
+			if err == nil {
+				job, err = loadProvisioningJob(fsCommand.Arguments.Path)
+			}
+
+			if err == nil {
+				err = job.checkLocalPaths()
+			}
+
+			if err == nil {
+				Provisioning.start(job)
+			} else {
+				notify("boardUpdate", err.Error())
+			}
+
+		case "provisioningStop":
+			Provisioning.stop()
+
+		case "inventoryList":
+			list, err := json.Marshal(Inventory.list())
+			if err == nil {
+				notify("inventoryList", string(list))
+			}
+
+		case "inventoryUpdate":
+			var inventoryCommand CommandInventory
+
+			json.Unmarshal([]byte(msg), &inventoryCommand)
+
+			entry, err := Inventory.update(inventoryCommand.Arguments.Key, inventoryCommand.Arguments.Name, inventoryCommand.Arguments.Notes)
+			if err == nil {
+				b, _ := json.Marshal(entry)
+				notify("inventoryUpdated", string(b))
+			} else {
+				notify("inventoryError", jsonString("message")+": "+jsonString(err.Error()))
+			}
+
+		case "inventoryRemove":
+			var inventoryCommand CommandInventory
+
+			json.Unmarshal([]byte(msg), &inventoryCommand)
+
+			if err := Inventory.remove(inventoryCommand.Arguments.Key); err == nil {
+				notify("inventoryRemoved", jsonString("key")+": "+jsonString(inventoryCommand.Arguments.Key))
+			} else {
+				notify("inventoryError", jsonString("message")+": "+jsonString(err.Error()))
+			}
+
 		case "boardUpgrade":
 			if connectedBoard != nil {
 				connectedBoard.upgrade(false, "")
@@ -426,6 +939,9 @@ func control(ws *websocket.Conn) {
 				notify("boardUpgraded", "")
 			}
 		}
+
+		BoardMutex.Unlock()
+		locked = false
 	}
 }
 
@@ -514,6 +1030,7 @@ func consoleDown(ws *websocket.Conn) {
 			}
 
 			if connectedBoard != nil {
+				connectedBoard.lastConsoleIn = time.Now()
 				connectedBoard.port.Write([]byte(msg))
 			}
 		}